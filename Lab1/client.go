@@ -1,15 +1,27 @@
 package main
 
 import (
+        "bufio"
+        "crypto/tls"
+        "crypto/x509"
+        "encoding/csv"
         "encoding/json"
+        "errors"
         "flag"
         "fmt"
+        "github.com/mattn/go-isatty"
         "github.com/skorobogatov/input"
+        "io"
         "net"
+        "os"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
         "lab1/src/proto"
 )
 
-const (
+var (
         Reset       = "\033[0m"
         NumberColor = "\033[1;34m" 
         DigitColor  = "\033[1;33m" 
@@ -17,51 +29,538 @@ const (
         ErrorColor  = "\033[1;31m" 
 )
 
-func interact(conn *net.TCPConn) {
-        defer conn.Close()
-        encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+var operators = map[string]string{
+        proto.OpAdd: "+",
+        proto.OpSub: "-",
+        proto.OpMul: "*",
+        proto.OpDiv: "/",
+        proto.OpMod: "%",
+}
 
-        for {
-                fmt.Printf("%sEnter number: %s", NumberColor, Reset)
-                number := input.Gets()
+func handshake(codec proto.Codec) ([]string, error) {
+        request := proto.Request{
+                Version: proto.Version,
+                Op:      proto.OpHello,
+        }
+        if err := codec.Encode(&request); err != nil {
+                return nil, err
+        }
+        var response proto.Response
+        if err := codec.Decode(&response); err != nil {
+                return nil, err
+        }
+        if response.Status != "ok" || response.Version < 2 {
+                return []string{proto.OpCount}, nil
+        }
+        return response.Ops, nil
+}
+
+func contains(list []string, value string) bool {
+        for _, item := range list {
+                if item == value {
+                        return true
+                }
+        }
+        return false
+}
+
+func readRequest(op string) proto.Request {
+        request := proto.Request{Op: op}
+        fmt.Printf("%sEnter number: %s", NumberColor, Reset)
+        request.Number = input.Gets()
+        switch op {
+        case proto.OpCount:
                 fmt.Printf("%sEnter digit: %s", DigitColor, Reset)
-                digit := input.Gets()
-                request := proto.Request{
-                        Number: number,
-                        Digit:  digit,
+                request.Digit = input.Gets()
+        case proto.OpConvert:
+                fmt.Printf("%sEnter source base: %s", DigitColor, Reset)
+                request.FromBase, _ = strconv.Atoi(input.Gets())
+                fmt.Printf("%sEnter target base: %s", DigitColor, Reset)
+                request.ToBase, _ = strconv.Atoi(input.Gets())
+        case proto.OpAdd, proto.OpSub, proto.OpMul, proto.OpDiv, proto.OpMod:
+                fmt.Printf("%sEnter operand: %s", DigitColor, Reset)
+                request.Operand = input.Gets()
+        }
+        return request
+}
+
+func printResult(request proto.Request, response proto.Response) {
+        switch request.Op {
+        case proto.OpCount:
+                fmt.Printf("Digit %s%s%s occurs %s%s%s times in the number %s%s%s\n",
+                        DigitColor, request.Digit, Reset,
+                        CountColor, fmt.Sprintf("%d", response.Count), Reset,
+                        NumberColor, request.Number, Reset)
+        case proto.OpHistogram:
+                for digit, count := range response.Histogram {
+                        fmt.Printf("Digit %s%d%s occurs %s%d%s times in the number %s%s%s\n",
+                                DigitColor, digit, Reset,
+                                CountColor, count, Reset,
+                                NumberColor, request.Number, Reset)
+                }
+        case proto.OpDigitSum:
+                fmt.Printf("Sum of digits of the number %s%s%s is %s%s%s\n",
+                        NumberColor, request.Number, Reset,
+                        CountColor, response.Result, Reset)
+        case proto.OpConvert:
+                fmt.Printf("Number %s%s%s in base %s%d%s is %s%s%s\n",
+                        NumberColor, request.Number, Reset,
+                        DigitColor, request.ToBase, Reset,
+                        CountColor, response.Result, Reset)
+        default:
+                fmt.Printf("%s%s%s %s %s%s%s = %s%s%s\n",
+                        NumberColor, request.Number, Reset,
+                        operators[request.Op],
+                        DigitColor, request.Operand, Reset,
+                        CountColor, response.Result, Reset)
+        }
+}
+
+func newCodec(conn net.Conn, framing string) (proto.Codec, error) {
+        switch framing {
+        case "none":
+                return proto.NewStreamCodec(conn, conn), nil
+        case "json", "binary":
+                format := proto.FormatJSON
+                if framing == "binary" {
+                        format = proto.FormatBinary
+                }
+                if err := proto.RequestFraming(conn, format); err != nil {
+                        return nil, err
+                }
+                return proto.NewFrameCodec(conn, conn, format), nil
+        }
+        return nil, fmt.Errorf("unknown framing %q", framing)
+}
+
+func parseRequest(op string, fields []string) (proto.Request, error) {
+        request := proto.Request{Op: op}
+        want := 1
+        switch op {
+        case proto.OpCount:
+                want = 2
+        case proto.OpConvert:
+                want = 3
+        case proto.OpAdd, proto.OpSub, proto.OpMul, proto.OpDiv, proto.OpMod:
+                want = 2
+        }
+        if len(fields) != want {
+                return request, fmt.Errorf("expected %d fields, got %d", want, len(fields))
+        }
+        request.Number = fields[0]
+        switch op {
+        case proto.OpCount:
+                request.Digit = fields[1]
+        case proto.OpConvert:
+                var err error
+                if request.FromBase, err = strconv.Atoi(fields[1]); err != nil {
+                        return request, fmt.Errorf("invalid source base %q", fields[1])
+                }
+                if request.ToBase, err = strconv.Atoi(fields[2]); err != nil {
+                        return request, fmt.Errorf("invalid target base %q", fields[2])
+                }
+        case proto.OpAdd, proto.OpSub, proto.OpMul, proto.OpDiv, proto.OpMod:
+                request.Operand = fields[1]
+        }
+        return request, nil
+}
+
+func printResponse(request proto.Request, response proto.Response) {
+        switch response.Status {
+        case "ok":
+                printResult(request, response)
+        case "error":
+                fmt.Printf("%sError: %s%s\n", ErrorColor, response.Message, Reset)
+        }
+}
+
+type batchConfig struct {
+        path   string
+        input  string
+        output string
+}
+
+type batchResult struct {
+        Request  proto.Request  `json:"request"`
+        Response proto.Response `json:"response"`
+}
+
+func readBatch(r io.Reader, format string, op string, emit func(proto.Request) error) error {
+        report := func(line int, err error) {
+                fmt.Fprintf(os.Stderr, "%sError: line %d: %v%s\n", ErrorColor, line, err, Reset)
+        }
+        if format == "csv" {
+                reader := csv.NewReader(r)
+                reader.FieldsPerRecord = -1
+                reader.TrimLeadingSpace = true
+                for line := 1; ; line++ {
+                        record, err := reader.Read()
+                        if err == io.EOF {
+                                return nil
+                        }
+                        if err != nil {
+                                return err
+                        }
+                        if line == 1 && strings.EqualFold(record[0], "number") {
+                                continue
+                        }
+                        request, err := parseRequest(op, record)
+                        if err != nil {
+                                report(line, err)
+                                continue
+                        }
+                        if err := emit(request); err != nil {
+                                return err
+                        }
+                }
+        }
+        scanner := bufio.NewScanner(r)
+        for line := 1; scanner.Scan(); line++ {
+                text := strings.TrimSpace(scanner.Text())
+                if text == "" {
+                        continue
+                }
+                var request proto.Request
+                var err error
+                if format == "json" {
+                        err = json.Unmarshal([]byte(text), &request)
+                        if request.Op == "" {
+                                request.Op = op
+                        }
+                } else {
+                        request, err = parseRequest(op, strings.Fields(text))
+                }
+                if err != nil {
+                        report(line, err)
+                        continue
+                }
+                if err := emit(request); err != nil {
+                        return err
+                }
+        }
+        return scanner.Err()
+}
+
+func newResultWriter(format string) (func(proto.Request, proto.Response), func()) {
+        switch format {
+        case "csv":
+                writer := csv.NewWriter(os.Stdout)
+                writer.Write([]string{"id", "op", "number", "digit", "operand", "from_base", "to_base", "status", "message", "count", "result", "histogram"})
+                return func(request proto.Request, response proto.Response) {
+                        histogram := make([]string, len(response.Histogram))
+                        for i, count := range response.Histogram {
+                                histogram[i] = strconv.Itoa(count)
+                        }
+                        writer.Write([]string{
+                                strconv.FormatUint(request.ID, 10), request.Op, request.Number, request.Digit, request.Operand,
+                                strconv.Itoa(request.FromBase), strconv.Itoa(request.ToBase),
+                                response.Status, response.Message, strconv.Itoa(response.Count), response.Result,
+                                strings.Join(histogram, " "),
+                        })
+                        writer.Flush()
+                }, writer.Flush
+        case "json":
+                encoder := json.NewEncoder(os.Stdout)
+                return func(request proto.Request, response proto.Response) {
+                        encoder.Encode(batchResult{Request: request, Response: response})
+                }, func() {}
+        }
+        return printResponse, func() {}
+}
+
+func openBatch(path string) (io.ReadCloser, error) {
+        if path == "-" {
+                return io.NopCloser(os.Stdin), nil
+        }
+        return os.Open(path)
+}
+
+func runBatch(codec proto.Codec, op string, batch batchConfig) bool {
+        source, err := openBatch(batch.path)
+        if err != nil {
+                fmt.Fprintf(os.Stderr, "%sError: %v%s\n", ErrorColor, err, Reset)
+                return false
+        }
+        defer source.Close()
+        write, flush := newResultWriter(batch.output)
+        defer flush()
+
+        var lock sync.Mutex
+        pending := make(map[uint64]proto.Request)
+        sentAll := false
+        failed := false
+        done := make(chan struct{})
+        var once sync.Once
+        finish := func() { once.Do(func() { close(done) }) }
+
+        go func() {
+                defer finish()
+                for {
+                        var response proto.Response
+                        if err := codec.Decode(&response); err != nil {
+                                fmt.Fprintf(os.Stderr, "%sError: cannot decode response: %v%s\n", ErrorColor, err, Reset)
+                                lock.Lock()
+                                failed = true
+                                lock.Unlock()
+                                return
+                        }
+                        lock.Lock()
+                        request, ok := pending[response.ID]
+                        delete(pending, response.ID)
+                        complete := sentAll && len(pending) == 0
+                        lock.Unlock()
+                        if !ok {
+                                fmt.Fprintf(os.Stderr, "%sError: unexpected response with id %d%s\n", ErrorColor, response.ID, Reset)
+                                continue
+                        }
+                        write(request, response)
+                        if complete {
+                                return
+                        }
                 }
-                if err := encoder.Encode(&request); err != nil {
-                        fmt.Printf("%sError: cannot send request: %v%s\n", ErrorColor, err, Reset)
-                        return
+        }()
+
+        var id uint64
+        err = readBatch(source, batch.input, op, func(request proto.Request) error {
+                id++
+                request.ID = id
+                lock.Lock()
+                pending[id] = request
+                lock.Unlock()
+                return codec.Encode(&request)
+        })
+        if err != nil {
+                fmt.Fprintf(os.Stderr, "%sError: %v%s\n", ErrorColor, err, Reset)
+                return false
+        }
+        lock.Lock()
+        sentAll = true
+        if len(pending) == 0 {
+                finish()
+        }
+        lock.Unlock()
+        <-done
+        lock.Lock()
+        defer lock.Unlock()
+        return !failed
+}
+
+func disableColors() {
+        Reset, NumberColor, DigitColor, CountColor, ErrorColor = "", "", "", "", ""
+}
+
+func interact(conn net.Conn, op string, framing string, batch batchConfig) bool {
+        defer conn.Close()
+        codec, err := newCodec(conn, framing)
+        if err != nil {
+                fmt.Fprintf(os.Stderr, "%sError: %v%s\n", ErrorColor, err, Reset)
+                return false
+        }
+
+        ops, err := handshake(codec)
+        if err != nil {
+                fmt.Fprintf(os.Stderr, "%sError: handshake failed: %v%s\n", ErrorColor, err, Reset)
+                return false
+        }
+        if !contains(ops, op) {
+                fmt.Fprintf(os.Stderr, "%sError: server does not support operation %q%s\n", ErrorColor, op, Reset)
+                return false
+        }
+        if batch.path != "" {
+                return runBatch(codec, op, batch)
+        }
+
+        for {
+                request := readRequest(op)
+                if err := codec.Encode(&request); err != nil {
+                        fmt.Fprintf(os.Stderr, "%sError: cannot send request: %v%s\n", ErrorColor, err, Reset)
+                        return false
                 }
                 var response proto.Response
-                if err := decoder.Decode(&response); err != nil {
-                        fmt.Printf("%sError: cannot decode response: %v%s\n", ErrorColor, err, Reset)
-                        return
+                if err := codec.Decode(&response); err != nil {
+                        fmt.Fprintf(os.Stderr, "%sError: cannot decode response: %v%s\n", ErrorColor, err, Reset)
+                        return false
                 }
-                switch response.Status {
-                case "ok":
-                        fmt.Printf("Digit %s%s%s occurs %s%s%s times in the number %s%s%s\n",
-                                DigitColor, digit, Reset,
-                                CountColor, fmt.Sprintf("%d", response.Count), Reset,
-                                NumberColor, number, Reset)
-                case "error":
-                        fmt.Printf("%sError: %s%s\n", ErrorColor, response.Message, Reset)
+                printResponse(request, response)
+        }
+}
+
+type udpClient struct {
+        conn    net.Conn
+        timeout time.Duration
+        retries int
+        nextID  uint64
+}
+
+func (client *udpClient) exchange(request proto.Request) (proto.Response, error) {
+        client.nextID++
+        request.ID = client.nextID
+        request.Version = proto.Version
+        data, err := json.Marshal(&request)
+        if err != nil {
+                return proto.Response{}, err
+        }
+        buffer := make([]byte, 64*1024)
+        for attempt := 0; attempt <= client.retries; attempt++ {
+                if _, err := client.conn.Write(data); err != nil {
+                        return proto.Response{}, err
+                }
+                client.conn.SetReadDeadline(time.Now().Add(client.timeout))
+                for {
+                        n, err := client.conn.Read(buffer)
+                        if errors.Is(err, os.ErrDeadlineExceeded) {
+                                break
+                        }
+                        if err != nil {
+                                return proto.Response{}, err
+                        }
+                        var response proto.Response
+                        if err := json.Unmarshal(buffer[:n], &response); err != nil || response.ID != request.ID {
+                                continue
+                        }
+                        return response, nil
+                }
+        }
+        return proto.Response{}, fmt.Errorf("no response after %d attempts", client.retries+1)
+}
+
+func interactUDP(client *udpClient, op string, batch batchConfig) bool {
+        defer client.conn.Close()
+        if batch.path == "" {
+                for {
+                        request := readRequest(op)
+                        response, err := client.exchange(request)
+                        if err != nil {
+                                fmt.Fprintf(os.Stderr, "%sError: %v%s\n", ErrorColor, err, Reset)
+                                continue
+                        }
+                        printResponse(request, response)
+                }
+        }
+
+        source, err := openBatch(batch.path)
+        if err != nil {
+                fmt.Fprintf(os.Stderr, "%sError: %v%s\n", ErrorColor, err, Reset)
+                return false
+        }
+        defer source.Close()
+        write, flush := newResultWriter(batch.output)
+        defer flush()
+        ok := true
+        err = readBatch(source, batch.input, op, func(request proto.Request) error {
+                response, err := client.exchange(request)
+                if err != nil {
+                        fmt.Fprintf(os.Stderr, "%sError: number %s: %v%s\n", ErrorColor, request.Number, err, Reset)
+                        ok = false
+                        return nil
+                }
+                request.ID = response.ID
+                write(request, response)
+                return nil
+        })
+        if err != nil {
+                fmt.Fprintf(os.Stderr, "%sError: %v%s\n", ErrorColor, err, Reset)
+                return false
+        }
+        return ok
+}
+
+func clientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+        config := &tls.Config{MinVersion: tls.VersionTLS12}
+        if caFile != "" {
+                data, err := os.ReadFile(caFile)
+                if err != nil {
+                        return nil, err
+                }
+                config.RootCAs = x509.NewCertPool()
+                if !config.RootCAs.AppendCertsFromPEM(data) {
+                        return nil, fmt.Errorf("no certificates found in %s", caFile)
                 }
         }
+        if certFile != "" {
+                cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+                if err != nil {
+                        return nil, err
+                }
+                config.Certificates = []tls.Certificate{cert}
+        }
+        return config, nil
+}
+
+func dial(addrStr string, useTLS bool, caFile, certFile, keyFile string) (net.Conn, error) {
+        addr, err := net.ResolveTCPAddr("tcp", addrStr)
+        if err != nil {
+                return nil, err
+        }
+        conn, err := net.DialTCP("tcp", nil, addr)
+        if err != nil || !useTLS {
+                return conn, err
+        }
+        config, err := clientTLSConfig(caFile, certFile, keyFile)
+        if err != nil {
+                conn.Close()
+                return nil, err
+        }
+        if host, _, err := net.SplitHostPort(addrStr); err == nil {
+                config.ServerName = host
+        }
+        tlsConn := tls.Client(conn, config)
+        if err := tlsConn.Handshake(); err != nil {
+                conn.Close()
+                return nil, err
+        }
+        return tlsConn, nil
 }
 
 func main() {
-        var addrStr string
+        var addrStr, op, framing, caFile, certFile, keyFile string
+        var useTLS, useUDP bool
+        var udpTimeout time.Duration
+        var udpRetries int
+        var batch batchConfig
         flag.StringVar(&addrStr, "addr", "185.102.139.169:9742", "specify IP address and port")
+        flag.StringVar(&op, "op", proto.OpCount, "specify operation: count, histogram, digitsum, convert, add, sub, mul, div, mod")
+        flag.StringVar(&framing, "framing", "none", "specify wire format: none (JSON stream), json or binary frames")
+        flag.StringVar(&batch.path, "batch", "", "send every record of the file (- for stdin) as a pipelined request")
+        flag.StringVar(&batch.input, "input", "text", "batch input format: text, csv or json (JSON lines)")
+        flag.StringVar(&batch.output, "output", "text", "batch output format: text, csv or json (JSON lines)")
+        flag.BoolVar(&useTLS, "tls", false, "connect over TLS")
+        flag.StringVar(&caFile, "ca", "", "verify the server certificate against this CA file")
+        flag.StringVar(&certFile, "cert", "", "present this client certificate file")
+        flag.StringVar(&keyFile, "key", "", "private key file for the client certificate")
+        flag.BoolVar(&useUDP, "udp", false, "send each request as a single UDP datagram")
+        flag.DurationVar(&udpTimeout, "timeout", time.Second, "UDP reply timeout per attempt")
+        flag.IntVar(&udpRetries, "retries", 3, "UDP retransmissions before giving up")
         flag.Parse()
 
-        if addr, err := net.ResolveTCPAddr("tcp", addrStr); err != nil {
-                fmt.Printf("%sError: %v%s\n", ErrorColor, err, Reset)
-        } else if conn, err := net.DialTCP("tcp", nil, addr); err != nil {
-                fmt.Printf("%sError: %v%s\n", ErrorColor, err, Reset)
-        } else {
-                interact(conn)
+        if !isatty.IsTerminal(os.Stdout.Fd()) && !isatty.IsCygwinTerminal(os.Stdout.Fd()) {
+                disableColors()
+        }
+        if _, ok := operators[op]; !ok && !contains([]string{proto.OpCount, proto.OpHistogram, proto.OpDigitSum, proto.OpConvert}, op) {
+                fmt.Fprintf(os.Stderr, "%sError: unknown operation %q%s\n", ErrorColor, op, Reset)
+                os.Exit(1)
+        }
+        if useUDP {
+                if useTLS {
+                        fmt.Fprintf(os.Stderr, "%sError: -tls cannot be combined with -udp%s\n", ErrorColor, Reset)
+                        os.Exit(1)
+                }
+                conn, err := net.Dial("udp", addrStr)
+                if err != nil {
+                        fmt.Fprintf(os.Stderr, "%sError: %v%s\n", ErrorColor, err, Reset)
+                        os.Exit(1)
+                }
+                if !interactUDP(&udpClient{conn: conn, timeout: udpTimeout, retries: udpRetries}, op, batch) {
+                        os.Exit(1)
+                }
+                return
+        }
+        conn, err := dial(addrStr, useTLS, caFile, certFile, keyFile)
+        if err != nil {
+                fmt.Fprintf(os.Stderr, "%sError: %v%s\n", ErrorColor, err, Reset)
+                os.Exit(1)
+        }
+        if !interact(conn, op, framing, batch) {
+                os.Exit(1)
         }
 }
-
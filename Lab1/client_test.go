@@ -0,0 +1,105 @@
+package main
+
+import (
+        "encoding/json"
+        "io"
+        "net"
+        "os"
+        "path/filepath"
+        "strings"
+        "testing"
+        "time"
+        "lab1/src/numserver"
+        "lab1/src/proto"
+)
+
+func TestInteractBatch(t *testing.T) {
+        listener, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatalf("listen: %v", err)
+        }
+        server := numserver.NewServer(listener, numserver.Limits{})
+        go server.Serve()
+        defer server.Shutdown(time.Second)
+
+        input := filepath.Join(t.TempDir(), "input.csv")
+        os.WriteFile(input, []byte("number,digit\n1223,2\n12a,1\n5,x\n"), 0644)
+
+        for _, framing := range []string{"none", "json", "binary"} {
+                conn, err := net.Dial("tcp", server.Addr().String())
+                if err != nil {
+                        t.Fatalf("dial: %v", err)
+                }
+                reader, writer, _ := os.Pipe()
+                stdout := os.Stdout
+                os.Stdout = writer
+                ok := interact(conn, proto.OpCount, framing, batchConfig{path: input, input: "csv", output: "json"})
+                os.Stdout = stdout
+                writer.Close()
+                output, _ := io.ReadAll(reader)
+                if !ok {
+                        t.Fatalf("%s: interact failed", framing)
+                }
+
+                results := make(map[string]proto.Response)
+                for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+                        var result batchResult
+                        if err := json.Unmarshal([]byte(line), &result); err != nil {
+                                t.Fatalf("%s: bad output line %q: %v", framing, line, err)
+                        }
+                        results[result.Request.Number] = result.Response
+                }
+                if resp := results["1223"]; resp.Status != "ok" || resp.Count != 2 {
+                        t.Errorf("%s: 1223 -> %+v", framing, resp)
+                }
+                if resp := results["12a"]; resp.Message != "Invalid number" {
+                        t.Errorf("%s: 12a -> %+v", framing, resp)
+                }
+                if resp := results["5"]; resp.Message != "Invalid digit" {
+                        t.Errorf("%s: 5 -> %+v", framing, resp)
+                }
+        }
+}
+
+func TestUDPExchangeDiscardsStaleReplies(t *testing.T) {
+        packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatalf("listen: %v", err)
+        }
+        defer packetConn.Close()
+        go func() {
+                buffer := make([]byte, 64*1024)
+                for attempt := 0; ; attempt++ {
+                        n, addr, err := packetConn.ReadFrom(buffer)
+                        if err != nil {
+                                return
+                        }
+                        if attempt == 0 {
+                                continue
+                        }
+                        var request proto.Request
+                        json.Unmarshal(buffer[:n], &request)
+                        stale, _ := json.Marshal(proto.Response{ID: request.ID + 100, Status: "ok", Count: 99})
+                        reply, _ := json.Marshal(proto.Response{ID: request.ID, Status: "ok", Count: 1})
+                        packetConn.WriteTo(stale, addr)
+                        packetConn.WriteTo(reply, addr)
+                        packetConn.WriteTo(reply, addr)
+                }
+        }()
+
+        conn, err := net.Dial("udp", packetConn.LocalAddr().String())
+        if err != nil {
+                t.Fatalf("dial: %v", err)
+        }
+        client := &udpClient{conn: conn, timeout: 100 * time.Millisecond, retries: 2}
+        defer conn.Close()
+        for i := 0; i < 2; i++ {
+                response, err := client.exchange(proto.Request{Op: proto.OpCount, Number: "1", Digit: "1"})
+                if err != nil {
+                        t.Fatalf("exchange %d: %v", i, err)
+                }
+                if response.ID != client.nextID || response.Count != 1 {
+                        t.Errorf("exchange %d = %+v, want id %d count 1", i, response, client.nextID)
+                }
+        }
+}
@@ -3,10 +3,14 @@ module lab1
 go 1.21.4
 
 require (
-        github.com/mattn/go-colorable v0.1.13 // indirect
-        github.com/mattn/go-isatty v0.0.20 // indirect
-        github.com/mgutz/ansi v0.0.0-20200706080929-d51e80ef957d // indirect
-        github.com/mgutz/logxi v0.0.0-20161027140823-aebf8a7d67ab // indirect
-        github.com/skorobogatov/input v0.0.0-20130306234943-1101603a3b41 // indirect
-        golang.org/x/sys v0.6.0 // indirect
+	github.com/gorilla/websocket v1.5.3
+	github.com/mattn/go-isatty v0.0.20
+	github.com/mgutz/logxi v0.0.0-20161027140823-aebf8a7d67ab
+	github.com/skorobogatov/input v0.0.0-20130306234943-1101603a3b41
+)
+
+require (
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mgutz/ansi v0.0.0-20200706080929-d51e80ef957d // indirect
+	golang.org/x/sys v0.6.0 // indirect
 )
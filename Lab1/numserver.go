@@ -0,0 +1,825 @@
+package numserver
+
+import (
+        "bufio"
+        "crypto/tls"
+        "crypto/x509"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "github.com/gorilla/websocket"
+        "github.com/mgutz/logxi/v1"
+        "io"
+        "math/big"
+        "net"
+        "net/http"
+        "os"
+        "sort"
+        "strings"
+        "strconv"
+        "sync"
+        "sync/atomic"
+        "time"
+        "lab1/src/proto"
+)
+
+type Operation func(req proto.Request) proto.Response
+
+var operations = make(map[string]Operation)
+
+func RegisterOperation(op string, handler Operation) {
+        operations[op] = handler
+}
+
+func init() {
+        RegisterOperation(proto.OpCount, countDigit)
+        RegisterOperation(proto.OpHistogram, digitHistogram)
+        RegisterOperation(proto.OpDigitSum, digitSum)
+        RegisterOperation(proto.OpConvert, convertBase)
+        RegisterOperation(proto.OpAdd, arithmetic((*big.Int).Add, false))
+        RegisterOperation(proto.OpSub, arithmetic((*big.Int).Sub, false))
+        RegisterOperation(proto.OpMul, arithmetic((*big.Int).Mul, false))
+        RegisterOperation(proto.OpDiv, arithmetic((*big.Int).Quo, true))
+        RegisterOperation(proto.OpMod, arithmetic((*big.Int).Rem, true))
+}
+
+func operationNames() []string {
+        names := make([]string, 0, len(operations))
+        for name := range operations {
+                names = append(names, name)
+        }
+        sort.Strings(names)
+        return names
+}
+
+const MaxPipelined = 64
+
+type Limits struct {
+        MaxConns    int
+        IdleTimeout time.Duration
+        ReadTimeout time.Duration
+        Rate        float64
+}
+
+type Server struct {
+        logger   log.Logger
+        output   io.Writer
+        listener net.Listener
+        limits   Limits
+        lock     sync.Mutex
+        clients  map[*Client]struct{}
+        gateway  int
+        senders  map[string]*rateLimiter
+        active   sync.WaitGroup
+        closing  bool
+        packets  []net.PacketConn
+        metrics  *Metrics
+}
+
+func NewServer(listener net.Listener, limits Limits) *Server {
+        return &Server{
+                logger:   log.New("server"),
+                listener: listener,
+                limits:   limits,
+                clients:  make(map[*Client]struct{}),
+                senders:  make(map[string]*rateLimiter),
+                metrics:  newMetrics(),
+        }
+}
+
+func (server *Server) SetLogOutput(w io.Writer) {
+        server.output = log.NewConcurrentWriter(w)
+        server.logger = server.newLogger("server")
+}
+
+func (server *Server) newLogger(name string) log.Logger {
+        if server.output == nil {
+                return log.New(name)
+        }
+        return log.NewLogger(server.output, name)
+}
+
+func (server *Server) Metrics() *Metrics {
+        return server.metrics
+}
+
+func (server *Server) Addr() net.Addr {
+        return server.listener.Addr()
+}
+
+func (server *Server) Serve() {
+        for {
+                conn, err := server.listener.Accept()
+                if err != nil {
+                        if server.isClosing() {
+                                return
+                        }
+                        server.logger.Error("cannot accept connection", "reason", err)
+                        continue
+                }
+                server.logger.Info("accepted connection", "address", conn.RemoteAddr().String())
+                server.metrics.accepted.Add(1)
+                client := NewClient(conn, server)
+                if !server.register(client) {
+                        server.logger.Warn("connection limit reached", "address", conn.RemoteAddr().String())
+                        server.metrics.rejected.Add(1)
+                        go reject(conn, "Too many connections")
+                        continue
+                }
+                go func() {
+                        defer server.unregister(client)
+                        client.serve()
+                }()
+        }
+}
+
+func (server *Server) register(client *Client) bool {
+        server.lock.Lock()
+        defer server.lock.Unlock()
+        if server.full() {
+                return false
+        }
+        server.clients[client] = struct{}{}
+        server.active.Add(1)
+        server.metrics.active.Add(1)
+        return true
+}
+
+func (server *Server) full() bool {
+        return server.closing || (server.limits.MaxConns > 0 && len(server.clients)+server.gateway >= server.limits.MaxConns)
+}
+
+func (server *Server) unregister(client *Client) {
+        server.lock.Lock()
+        delete(server.clients, client)
+        server.lock.Unlock()
+        server.metrics.active.Add(-1)
+        server.active.Done()
+}
+
+func (server *Server) isClosing() bool {
+        server.lock.Lock()
+        defer server.lock.Unlock()
+        return server.closing
+}
+
+func (server *Server) Shutdown(timeout time.Duration) {
+        server.lock.Lock()
+        server.closing = true
+        server.listener.Close()
+        for client := range server.clients {
+                client.conn.SetReadDeadline(time.Now())
+        }
+        for _, conn := range server.packets {
+                conn.SetReadDeadline(time.Now())
+        }
+        server.lock.Unlock()
+
+        drained := make(chan struct{})
+        go func() {
+                server.active.Wait()
+                close(drained)
+        }()
+        select {
+        case <-drained:
+                server.logger.Info("all clients drained")
+        case <-time.After(timeout):
+                server.logger.Warn("shutdown timeout, closing remaining connections")
+                server.lock.Lock()
+                for client := range server.clients {
+                        client.conn.Close()
+                }
+                server.lock.Unlock()
+                <-drained
+        }
+}
+
+func (server *Server) ServeUDP(conn net.PacketConn) {
+        defer conn.Close()
+        server.lock.Lock()
+        if server.closing {
+                server.lock.Unlock()
+                return
+        }
+        server.packets = append(server.packets, conn)
+        server.active.Add(1)
+        server.lock.Unlock()
+        defer server.active.Done()
+
+        buffer := make([]byte, 64*1024)
+        for {
+                n, addr, err := conn.ReadFrom(buffer)
+                if err != nil {
+                        if server.isClosing() {
+                                return
+                        }
+                        server.logger.Error("cannot read datagram", "reason", err)
+                        continue
+                }
+                received := time.Now()
+                var req proto.Request
+                var response proto.Response
+                if err := json.Unmarshal(buffer[:n], &req); err != nil {
+                        server.logger.Warn("malformed datagram", "address", addr.String(), "reason", err)
+                        response = ErrorResponse("Malformed request")
+                } else {
+                        server.logger.Info("received datagram", "address", addr.String(), "id", req.ID, "op", req.Op, "number", req.Number, "digit", req.Digit)
+                        version := negotiateVersion(req.Version)
+                        response = helloResponse(version)
+                        if req.Op != proto.OpHello {
+                                response = Execute(req, version)
+                        }
+                }
+                response.ID = req.ID
+                server.metrics.observe(response.Status, time.Since(received))
+                data, err := json.Marshal(&response)
+                if err != nil {
+                        server.logger.Error("cannot encode response", "reason", err)
+                        continue
+                }
+                if _, err := conn.WriteTo(data, addr); err != nil {
+                        server.logger.Error("cannot send response", "address", addr.String(), "reason", err)
+                }
+        }
+}
+
+func reject(conn net.Conn, message string) {
+        defer conn.Close()
+        conn.SetDeadline(time.Now().Add(time.Second))
+        json.NewEncoder(conn).Encode(ErrorResponse(message))
+}
+
+type rateLimiter struct {
+        rate   float64
+        tokens float64
+        last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+        if rate <= 0 {
+                return nil
+        }
+        return &rateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (limiter *rateLimiter) allow() bool {
+        if limiter == nil {
+                return true
+        }
+        now := time.Now()
+        limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+        if limiter.tokens > limiter.rate {
+                limiter.tokens = limiter.rate
+        }
+        limiter.last = now
+        if limiter.tokens < 1 {
+                return false
+        }
+        limiter.tokens--
+        return true
+}
+
+type Client struct {
+        logger   log.Logger    
+        conn     net.Conn  
+        server   *Server
+        codec    proto.Codec
+        version  int
+        limiter  *rateLimiter
+        sendLock sync.Mutex
+        inFlight sync.WaitGroup
+        reading  bool
+}
+
+func NewClient(conn net.Conn, server *Server) *Client {
+        return &Client{
+                logger:  server.newLogger(fmt.Sprintf("client %s", conn.RemoteAddr().String())),
+                conn:    conn,
+                server:  server,
+                version: 1,
+                limiter: newRateLimiter(server.limits.Rate),
+        }
+}
+
+func (client *Client) awaitRequest() bool {
+        client.server.lock.Lock()
+        defer client.server.lock.Unlock()
+        if client.server.closing {
+                return false
+        }
+        var deadline time.Time
+        if client.server.limits.IdleTimeout > 0 {
+                deadline = time.Now().Add(client.server.limits.IdleTimeout)
+        }
+        client.conn.SetReadDeadline(deadline)
+        client.reading = false
+        return true
+}
+
+type requestReader struct {
+        client *Client
+}
+
+func (r requestReader) Read(p []byte) (int, error) {
+        client := r.client
+        n, err := client.conn.Read(p)
+        if n > 0 && !client.reading {
+                client.reading = true
+                client.server.lock.Lock()
+                if !client.server.closing && client.server.limits.ReadTimeout > 0 {
+                        client.conn.SetReadDeadline(time.Now().Add(client.server.limits.ReadTimeout))
+                }
+                client.server.lock.Unlock()
+        }
+        return n, err
+}
+
+func (client *Client) serve() {
+        defer client.conn.Close()
+        defer client.inFlight.Wait()
+        if client.server.limits.ReadTimeout > 0 {
+                client.conn.SetDeadline(time.Now().Add(client.server.limits.ReadTimeout))
+        }
+        if tlsConn, ok := client.conn.(*tls.Conn); ok {
+                if err := tlsConn.Handshake(); err != nil {
+                        client.logger.Error("TLS handshake failed", "reason", err)
+                        return
+                }
+                if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+                        cn := certs[0].Subject.CommonName
+                        client.logger = client.server.newLogger(fmt.Sprintf("client %s (%s)", client.conn.RemoteAddr().String(), cn))
+                        client.logger.Info("client certificate verified", "cn", cn)
+                }
+        }
+        client.conn.SetDeadline(time.Time{})
+        if !client.awaitRequest() {
+                return
+        }
+        reader := bufio.NewReader(requestReader{client})
+        format, framed, err := proto.AcceptFraming(reader, client.conn)
+        if err != nil {
+                client.logger.Error("cannot negotiate framing", "reason", err)
+                return
+        }
+        if framed {
+                client.logger.Info("using framed transport", "format", string(format))
+                client.codec = proto.NewFrameCodec(reader, client.conn, format)
+        } else {
+                client.codec = proto.NewStreamCodec(reader, client.conn)
+        }
+        slots := make(chan struct{}, MaxPipelined)
+        for client.awaitRequest() {
+                var req proto.Request
+                err := client.codec.Decode(&req)
+                received := time.Now()
+                if err != nil {
+                        if err == io.EOF {
+                                client.logger.Info("client disconnected", "address", client.conn.RemoteAddr().String())
+                                break
+                        }
+                        if errors.Is(err, proto.ErrMalformed) {
+                                client.logger.Warn("malformed request", "reason", err)
+                                client.send(0, received, ErrorResponse("Malformed request"))
+                                continue
+                        }
+                        if errors.Is(err, os.ErrDeadlineExceeded) {
+                                if client.server.isClosing() {
+                                        client.logger.Info("closing connection for shutdown")
+                                } else if client.reading {
+                                        client.logger.Warn("read timeout, dropping partial request")
+                                } else {
+                                        client.logger.Info("idle timeout, closing connection")
+                                }
+                                break
+                        }
+                        client.logger.Error("cannot decode message", "reason", err)
+                        break
+                }
+                client.logger.Info("received request", "id", req.ID, "op", req.Op, "number", req.Number, "digit", req.Digit)
+                if req.Op == proto.OpHello {
+                        client.handshake(req, received)
+                        continue
+                }
+                if !client.limiter.allow() {
+                        client.logger.Warn("rate limit exceeded", "id", req.ID)
+                        client.send(req.ID, received, ErrorResponse("Rate limit exceeded"))
+                        continue
+                }
+                slots <- struct{}{}
+                client.inFlight.Add(1)
+                go func(req proto.Request, version int) {
+                        defer client.inFlight.Done()
+                        defer func() { <-slots }()
+                        client.handleRequest(req, version, received)
+                }(req, client.version)
+        }
+}
+
+func (client *Client) handleRequest(req proto.Request, version int, received time.Time) {
+        client.send(req.ID, received, Execute(req, version))
+}
+
+func (client *Client) handshake(req proto.Request, received time.Time) {
+        client.version = negotiateVersion(req.Version)
+        client.logger.Info("negotiated protocol version", "version", client.version)
+        client.send(req.ID, received, helloResponse(client.version))
+}
+
+func negotiateVersion(requested int) int {
+        if requested < 1 {
+                return 1
+        }
+        if requested > proto.Version {
+                return proto.Version
+        }
+        return requested
+}
+
+func helloResponse(version int) proto.Response {
+        return proto.Response{
+                Status:  "ok",
+                Version: version,
+                Ops:     operationNames(),
+        }
+}
+
+func (client *Client) send(id uint64, received time.Time, response proto.Response) {
+        response.ID = id
+        client.server.metrics.observe(response.Status, time.Since(received))
+        client.sendLock.Lock()
+        defer client.sendLock.Unlock()
+        if err := client.codec.Encode(&response); err != nil {
+                client.logger.Error("cannot send response", "reason", err)
+        }
+}
+
+func Execute(req proto.Request, version int) proto.Response {
+        op := req.Op
+        if op == "" {
+                op = proto.OpCount
+        }
+        if op != proto.OpCount && version < 2 {
+                return ErrorResponse("Operation requires protocol version 2")
+        }
+        handler, ok := operations[op]
+        if !ok {
+                return ErrorResponse("Unknown operation")
+        }
+        return handler(req)
+}
+
+func ErrorResponse(message string) proto.Response {
+        return proto.Response{
+                Status:  "error",
+                Message: message,
+        }
+}
+
+func countDigit(req proto.Request) proto.Response {
+        if len(req.Digit) != 1 || !strings.Contains("0123456789", req.Digit) {
+                return ErrorResponse("Invalid digit")
+        }
+        if _, err := strconv.Atoi(req.Number); err != nil {
+                return ErrorResponse("Invalid number")
+        }
+        return proto.Response{
+                Status: "ok",
+                Count:  strings.Count(req.Number, req.Digit),
+        }
+}
+
+func parseNumber(number string, base int) (*big.Int, bool) {
+        return new(big.Int).SetString(number, base)
+}
+
+func digitsOf(number string) []int {
+        digits := make([]int, 0, len(number))
+        for _, r := range strings.TrimLeft(number, "+-") {
+                digits = append(digits, int(r-'0'))
+        }
+        return digits
+}
+
+func digitHistogram(req proto.Request) proto.Response {
+        if _, ok := parseNumber(req.Number, 10); !ok {
+                return ErrorResponse("Invalid number")
+        }
+        histogram := make([]int, 10)
+        for _, digit := range digitsOf(req.Number) {
+                histogram[digit]++
+        }
+        return proto.Response{
+                Status:    "ok",
+                Histogram: histogram,
+        }
+}
+
+func digitSum(req proto.Request) proto.Response {
+        if _, ok := parseNumber(req.Number, 10); !ok {
+                return ErrorResponse("Invalid number")
+        }
+        sum := 0
+        for _, digit := range digitsOf(req.Number) {
+                sum += digit
+        }
+        return proto.Response{
+                Status: "ok",
+                Result: strconv.Itoa(sum),
+        }
+}
+
+func convertBase(req proto.Request) proto.Response {
+        fromBase, toBase := req.FromBase, req.ToBase
+        if fromBase == 0 {
+                fromBase = 10
+        }
+        if fromBase < 2 || fromBase > 36 || toBase < 2 || toBase > 36 {
+                return ErrorResponse("Invalid base")
+        }
+        n, ok := parseNumber(req.Number, fromBase)
+        if !ok {
+                return ErrorResponse("Invalid number")
+        }
+        return proto.Response{
+                Status: "ok",
+                Result: n.Text(toBase),
+        }
+}
+
+func arithmetic(apply func(z, x, y *big.Int) *big.Int, divides bool) Operation {
+        return func(req proto.Request) proto.Response {
+                x, ok := parseNumber(req.Number, 10)
+                if !ok {
+                        return ErrorResponse("Invalid number")
+                }
+                y, ok := parseNumber(req.Operand, 10)
+                if !ok {
+                        return ErrorResponse("Invalid operand")
+                }
+                if divides && y.Sign() == 0 {
+                        return ErrorResponse("Division by zero")
+                }
+                return proto.Response{
+                        Status: "ok",
+                        Result: apply(new(big.Int), x, y).String(),
+                }
+        }
+}
+
+func TLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+        cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+        if err != nil {
+                return nil, err
+        }
+        config := &tls.Config{
+                Certificates: []tls.Certificate{cert},
+                MinVersion:   tls.VersionTLS12,
+        }
+        if clientCAFile != "" {
+                pool, err := loadCertPool(clientCAFile)
+                if err != nil {
+                        return nil, err
+                }
+                config.ClientCAs = pool
+                config.ClientAuth = tls.RequireAndVerifyClientCert
+        }
+        return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+        data, err := os.ReadFile(file)
+        if err != nil {
+                return nil, err
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(data) {
+                return nil, fmt.Errorf("no certificates found in %s", file)
+        }
+        return pool, nil
+}
+
+const MaxBodySize = 1 << 20
+
+var upgrader = websocket.Upgrader{
+        CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func (server *Server) Handler() http.Handler {
+        mux := http.NewServeMux()
+        mux.HandleFunc("/count", server.limitGateway(server.handleCount))
+        mux.HandleFunc("/ws", server.limitGateway(server.handleWebSocket))
+        return mux
+}
+
+func (server *Server) HTTPServer(addr string, config *tls.Config) *http.Server {
+        return &http.Server{
+                Addr:              addr,
+                Handler:           server.Handler(),
+                TLSConfig:         config,
+                ReadHeaderTimeout: server.limits.ReadTimeout,
+                ReadTimeout:       server.limits.ReadTimeout,
+                IdleTimeout:       server.limits.IdleTimeout,
+        }
+}
+
+func (server *Server) limitGateway(handler http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                server.lock.Lock()
+                if server.full() {
+                        server.lock.Unlock()
+                        server.logger.Warn("connection limit reached", "address", r.RemoteAddr)
+                        server.metrics.rejected.Add(1)
+                        writeJSON(w, http.StatusServiceUnavailable, ErrorResponse("Too many connections"))
+                        return
+                }
+                server.gateway++
+                server.lock.Unlock()
+                defer func() {
+                        server.lock.Lock()
+                        server.gateway--
+                        server.lock.Unlock()
+                }()
+                handler(w, r)
+        }
+}
+
+func (server *Server) allowSender(addr string) bool {
+        host, _, err := net.SplitHostPort(addr)
+        if err != nil {
+                host = addr
+        }
+        server.lock.Lock()
+        defer server.lock.Unlock()
+        limiter, ok := server.senders[host]
+        if !ok {
+                limiter = newRateLimiter(server.limits.Rate)
+                if limiter == nil {
+                        return true
+                }
+                for other, idle := range server.senders {
+                        if time.Since(idle.last) > time.Minute {
+                                delete(server.senders, other)
+                        }
+                }
+                server.senders[host] = limiter
+        }
+        return limiter.allow()
+}
+
+func (server *Server) handleCount(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                w.Header().Set("Allow", http.MethodPost)
+                writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse("Method not allowed"))
+                return
+        }
+        received := time.Now()
+        var req proto.Request
+        if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBodySize)).Decode(&req); err != nil {
+                server.logger.Warn("malformed HTTP request", "address", r.RemoteAddr, "reason", err)
+                server.metrics.observe("error", time.Since(received))
+                writeJSON(w, http.StatusBadRequest, ErrorResponse("Malformed request"))
+                return
+        }
+        server.logger.Info("received HTTP request", "address", r.RemoteAddr, "op", req.Op, "number", req.Number, "digit", req.Digit)
+        if req.Op != proto.OpHello && !server.allowSender(r.RemoteAddr) {
+                server.logger.Warn("rate limit exceeded", "address", r.RemoteAddr, "id", req.ID)
+                server.metrics.observe("error", time.Since(received))
+                writeJSON(w, http.StatusTooManyRequests, ErrorResponse("Rate limit exceeded"))
+                return
+        }
+        version := negotiateVersion(req.Version)
+        response := helloResponse(version)
+        if req.Op != proto.OpHello {
+                response = Execute(req, version)
+        }
+        response.ID = req.ID
+        server.metrics.observe(response.Status, time.Since(received))
+        writeJSON(w, http.StatusOK, response)
+}
+
+func writeJSON(w http.ResponseWriter, status int, response proto.Response) {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(status)
+        json.NewEncoder(w).Encode(&response)
+}
+
+func (server *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+                server.logger.Error("WebSocket upgrade failed", "address", r.RemoteAddr, "reason", err)
+                return
+        }
+        defer conn.Close()
+        server.metrics.accepted.Add(1)
+        server.metrics.active.Add(1)
+        defer server.metrics.active.Add(-1)
+        logger := server.newLogger(fmt.Sprintf("websocket %s", r.RemoteAddr))
+        logger.Info("WebSocket client connected")
+        conn.SetReadLimit(MaxBodySize)
+        limiter := newRateLimiter(server.limits.Rate)
+        version := 1
+        for {
+                if server.limits.IdleTimeout > 0 {
+                        conn.SetReadDeadline(time.Now().Add(server.limits.IdleTimeout))
+                }
+                _, data, err := conn.ReadMessage()
+                if err != nil {
+                        logger.Info("WebSocket client disconnected", "reason", err)
+                        return
+                }
+                received := time.Now()
+                var req proto.Request
+                var response proto.Response
+                if err := json.Unmarshal(data, &req); err != nil {
+                        logger.Warn("malformed request", "reason", err)
+                        response = ErrorResponse("Malformed request")
+                } else if req.Op == proto.OpHello {
+                        version = negotiateVersion(req.Version)
+                        logger.Info("negotiated protocol version", "version", version)
+                        response = helloResponse(version)
+                } else if !limiter.allow() {
+                        logger.Warn("rate limit exceeded", "id", req.ID)
+                        response = ErrorResponse("Rate limit exceeded")
+                } else {
+                        logger.Info("received request", "id", req.ID, "op", req.Op, "number", req.Number, "digit", req.Digit)
+                        response = Execute(req, version)
+                }
+                response.ID = req.ID
+                server.metrics.observe(response.Status, time.Since(received))
+                if err := conn.WriteJSON(&response); err != nil {
+                        logger.Error("cannot send response", "reason", err)
+                        return
+                }
+        }
+}
+
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+type Metrics struct {
+        accepted     atomic.Int64
+        rejected     atomic.Int64
+        active       atomic.Int64
+        lock         sync.Mutex
+        requests     map[string]uint64
+        bucketCounts []uint64
+        latencySum   float64
+        latencyCount uint64
+}
+
+func newMetrics() *Metrics {
+        return &Metrics{
+                requests:     map[string]uint64{"ok": 0, "error": 0},
+                bucketCounts: make([]uint64, len(latencyBuckets)),
+        }
+}
+
+func (metrics *Metrics) observe(status string, elapsed time.Duration) {
+        seconds := elapsed.Seconds()
+        metrics.lock.Lock()
+        defer metrics.lock.Unlock()
+        metrics.requests[status]++
+        for i, bound := range latencyBuckets {
+                if seconds <= bound {
+                        metrics.bucketCounts[i]++
+                }
+        }
+        metrics.latencySum += seconds
+        metrics.latencyCount++
+}
+
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        metrics.WriteTo(w)
+}
+
+func (metrics *Metrics) WriteTo(w io.Writer) (int64, error) {
+        var b strings.Builder
+        writeMetric := func(name, kind, help string, value interface{}) {
+                fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+        }
+        writeMetric("lab1_connections_accepted_total", "counter", "Accepted client connections.", metrics.accepted.Load())
+        writeMetric("lab1_connections_rejected_total", "counter", "Connections rejected by the connection limit.", metrics.rejected.Load())
+        writeMetric("lab1_active_clients", "gauge", "Currently connected clients.", metrics.active.Load())
+
+        metrics.lock.Lock()
+        statuses := make([]string, 0, len(metrics.requests))
+        for status := range metrics.requests {
+                statuses = append(statuses, status)
+        }
+        sort.Strings(statuses)
+        b.WriteString("# HELP lab1_requests_total Answered requests by response status.\n# TYPE lab1_requests_total counter\n")
+        for _, status := range statuses {
+                fmt.Fprintf(&b, "lab1_requests_total{status=%q} %d\n", status, metrics.requests[status])
+        }
+        b.WriteString("# HELP lab1_request_duration_seconds Time from receiving a request to sending its response.\n# TYPE lab1_request_duration_seconds histogram\n")
+        for i, bound := range latencyBuckets {
+                fmt.Fprintf(&b, "lab1_request_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), metrics.bucketCounts[i])
+        }
+        fmt.Fprintf(&b, "lab1_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", metrics.latencyCount)
+        fmt.Fprintf(&b, "lab1_request_duration_seconds_sum %s\n", strconv.FormatFloat(metrics.latencySum, 'g', -1, 64))
+        fmt.Fprintf(&b, "lab1_request_duration_seconds_count %d\n", metrics.latencyCount)
+        metrics.lock.Unlock()
+
+        n, err := io.WriteString(w, b.String())
+        return int64(n), err
+}
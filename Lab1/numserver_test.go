@@ -0,0 +1,590 @@
+package numserver_test
+
+import (
+        "bufio"
+        "bytes"
+        "crypto/ecdsa"
+        "crypto/elliptic"
+        "crypto/rand"
+        "crypto/tls"
+        "crypto/x509"
+        "crypto/x509/pkix"
+        "encoding/json"
+        "encoding/pem"
+        "github.com/gorilla/websocket"
+        "github.com/mgutz/logxi/v1"
+        "io"
+        "math/big"
+        "net"
+        "net/http"
+        "net/http/httptest"
+        "os"
+        "path/filepath"
+        "strings"
+        "sync"
+        "testing"
+        "time"
+        "lab1/src/numserver"
+        "lab1/src/proto"
+)
+
+func startServer(t *testing.T, limits numserver.Limits) *numserver.Server {
+        t.Helper()
+        listener, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatalf("listen: %v", err)
+        }
+        server := numserver.NewServer(listener, limits)
+        go server.Serve()
+        t.Cleanup(func() { server.Shutdown(time.Second) })
+        return server
+}
+
+type testConn struct {
+        net.Conn
+        enc *json.Encoder
+        dec *json.Decoder
+}
+
+func dial(t *testing.T, server *numserver.Server) *testConn {
+        t.Helper()
+        conn, err := net.Dial("tcp", server.Addr().String())
+        if err != nil {
+                t.Fatalf("dial: %v", err)
+        }
+        conn.SetDeadline(time.Now().Add(5 * time.Second))
+        t.Cleanup(func() { conn.Close() })
+        return &testConn{Conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(bufio.NewReader(conn))}
+}
+
+func (c *testConn) roundTrip(t *testing.T, req proto.Request) proto.Response {
+        t.Helper()
+        if err := c.enc.Encode(&req); err != nil {
+                t.Fatalf("send: %v", err)
+        }
+        var resp proto.Response
+        if err := c.dec.Decode(&resp); err != nil {
+                t.Fatalf("receive: %v", err)
+        }
+        return resp
+}
+
+func TestCount(t *testing.T) {
+        server := startServer(t, numserver.Limits{})
+        conn := dial(t, server)
+        tests := []struct {
+                number, digit string
+                status        string
+                message       string
+                count         int
+        }{
+                {"1223", "2", "ok", "", 2},
+                {"1000", "0", "ok", "", 3},
+                {"-505", "5", "ok", "", 2},
+                {"123", "9", "ok", "", 0},
+                {"123", "a", "error", "Invalid digit", 0},
+                {"123", "", "error", "Invalid digit", 0},
+                {"123", "12", "error", "Invalid digit", 0},
+                {"12a", "1", "error", "Invalid number", 0},
+                {"", "1", "error", "Invalid number", 0},
+                {"99999999999999999999999", "9", "error", "Invalid number", 0},
+        }
+        for _, tt := range tests {
+                resp := conn.roundTrip(t, proto.Request{Number: tt.number, Digit: tt.digit})
+                if resp.Status != tt.status || resp.Message != tt.message || resp.Count != tt.count {
+                        t.Errorf("count(%q, %q) = %+v, want status %q message %q count %d",
+                                tt.number, tt.digit, resp, tt.status, tt.message, tt.count)
+                }
+        }
+}
+
+func TestOperations(t *testing.T) {
+        server := startServer(t, numserver.Limits{})
+        conn := dial(t, server)
+        if resp := conn.roundTrip(t, proto.Request{Op: proto.OpAdd, Number: "1", Operand: "2"}); resp.Message != "Operation requires protocol version 2" {
+                t.Fatalf("operation before handshake = %+v, want version error", resp)
+        }
+        hello := conn.roundTrip(t, proto.Request{Op: proto.OpHello, Version: proto.Version})
+        if hello.Status != "ok" || hello.Version != proto.Version {
+                t.Fatalf("hello = %+v", hello)
+        }
+        tests := []struct {
+                req    proto.Request
+                status string
+                result string
+        }{
+                {proto.Request{Op: proto.OpAdd, Number: "99999999999999999999", Operand: "1"}, "ok", "100000000000000000000"},
+                {proto.Request{Op: proto.OpSub, Number: "1", Operand: "3"}, "ok", "-2"},
+                {proto.Request{Op: proto.OpMul, Number: "123456789123456789", Operand: "1000"}, "ok", "123456789123456789000"},
+                {proto.Request{Op: proto.OpDiv, Number: "7", Operand: "2"}, "ok", "3"},
+                {proto.Request{Op: proto.OpDiv, Number: "7", Operand: "0"}, "error", ""},
+                {proto.Request{Op: proto.OpMod, Number: "7", Operand: "x"}, "error", ""},
+                {proto.Request{Op: proto.OpDigitSum, Number: "98765"}, "ok", "35"},
+                {proto.Request{Op: proto.OpConvert, Number: "255", ToBase: 16}, "ok", "ff"},
+                {proto.Request{Op: proto.OpConvert, Number: "ff", FromBase: 16, ToBase: 2}, "ok", "11111111"},
+                {proto.Request{Op: proto.OpConvert, Number: "1", ToBase: 99}, "error", ""},
+                {proto.Request{Op: "nope", Number: "1"}, "error", ""},
+        }
+        for _, tt := range tests {
+                resp := conn.roundTrip(t, tt.req)
+                if resp.Status != tt.status || resp.Result != tt.result {
+                        t.Errorf("%s(%+v) = %+v, want status %q result %q", tt.req.Op, tt.req, resp, tt.status, tt.result)
+                }
+        }
+        resp := conn.roundTrip(t, proto.Request{Op: proto.OpHistogram, Number: "112"})
+        if len(resp.Histogram) != 10 || resp.Histogram[1] != 2 || resp.Histogram[2] != 1 {
+                t.Errorf("histogram(112) = %v", resp.Histogram)
+        }
+}
+
+func TestMalformedJSON(t *testing.T) {
+        server := startServer(t, numserver.Limits{})
+        conn := dial(t, server)
+        io.WriteString(conn, "{\"number\": oops}\n")
+        var resp proto.Response
+        if err := conn.dec.Decode(&resp); err != io.EOF {
+                t.Fatalf("after malformed JSON: got %+v, %v; want connection closed", resp, err)
+        }
+}
+
+func TestMalformedFrame(t *testing.T) {
+        server := startServer(t, numserver.Limits{})
+        conn := dial(t, server)
+        if err := proto.RequestFraming(conn, proto.FormatJSON); err != nil {
+                t.Fatalf("negotiate framing: %v", err)
+        }
+        codec := proto.NewFrameCodec(conn, conn, proto.FormatJSON)
+        proto.WriteFrame(conn, []byte("{\"number\": oops}"))
+        var resp proto.Response
+        if err := codec.Decode(&resp); err != nil || resp.Message != "Malformed request" {
+                t.Fatalf("malformed frame = %+v, %v", resp, err)
+        }
+        codec.Encode(&proto.Request{Number: "77", Digit: "7"})
+        if err := codec.Decode(&resp); err != nil || resp.Count != 2 {
+                t.Fatalf("request after malformed frame = %+v, %v", resp, err)
+        }
+}
+
+func TestPipelining(t *testing.T) {
+        server := startServer(t, numserver.Limits{})
+        conn := dial(t, server)
+        const n = 500
+        go func() {
+                for i := 1; i <= n; i++ {
+                        conn.enc.Encode(&proto.Request{ID: uint64(i), Number: strings.Repeat("7", i%9+1), Digit: "7"})
+                }
+        }()
+        seen := make(map[uint64]bool)
+        for len(seen) < n {
+                var resp proto.Response
+                if err := conn.dec.Decode(&resp); err != nil {
+                        t.Fatalf("receive: %v", err)
+                }
+                if seen[resp.ID] {
+                        t.Fatalf("duplicate response for id %d", resp.ID)
+                }
+                seen[resp.ID] = true
+                if want := int(resp.ID)%9 + 1; resp.Count != want {
+                        t.Errorf("id %d: count %d, want %d", resp.ID, resp.Count, want)
+                }
+        }
+}
+
+func TestAbruptDisconnect(t *testing.T) {
+        server := startServer(t, numserver.Limits{MaxConns: 1})
+        for i := 0; i < 3; i++ {
+                conn := dial(t, server)
+                io.WriteString(conn, "{\"number\": \"12")
+                conn.Close()
+                time.Sleep(50 * time.Millisecond)
+        }
+        conn := dial(t, server)
+        if resp := conn.roundTrip(t, proto.Request{Number: "12", Digit: "1"}); resp.Status != "ok" || resp.Count != 1 {
+                t.Fatalf("request after abrupt disconnects = %+v", resp)
+        }
+}
+
+func TestLimits(t *testing.T) {
+        server := startServer(t, numserver.Limits{MaxConns: 1, Rate: 1, IdleTimeout: 200 * time.Millisecond})
+        conn := dial(t, server)
+        if resp := conn.roundTrip(t, proto.Request{Number: "1", Digit: "1"}); resp.Status != "ok" {
+                t.Fatalf("first request = %+v", resp)
+        }
+        if resp := conn.roundTrip(t, proto.Request{Number: "1", Digit: "1"}); resp.Message != "Rate limit exceeded" {
+                t.Fatalf("second request = %+v, want rate limit error", resp)
+        }
+        extra := dial(t, server)
+        var resp proto.Response
+        if err := extra.dec.Decode(&resp); err != nil || resp.Message != "Too many connections" {
+                t.Fatalf("extra connection = %+v, %v", resp, err)
+        }
+        if err := conn.dec.Decode(&resp); err != io.EOF {
+                t.Fatalf("idle connection = %+v, %v; want closed", resp, err)
+        }
+}
+
+func TestReadTimeout(t *testing.T) {
+        server := startServer(t, numserver.Limits{IdleTimeout: 5 * time.Second, ReadTimeout: 200 * time.Millisecond})
+        conn := dial(t, server)
+        if resp := conn.roundTrip(t, proto.Request{Number: "12", Digit: "1"}); resp.Status != "ok" {
+                t.Fatalf("first request = %+v", resp)
+        }
+        time.Sleep(400 * time.Millisecond)
+        if resp := conn.roundTrip(t, proto.Request{Number: "12", Digit: "2"}); resp.Status != "ok" {
+                t.Fatalf("request after an idle pause = %+v", resp)
+        }
+        io.WriteString(conn, "{\"number\": \"12")
+        start := time.Now()
+        var resp proto.Response
+        if err := conn.dec.Decode(&resp); err != io.EOF {
+                t.Fatalf("slow partial request = %+v, %v; want closed", resp, err)
+        }
+        if elapsed := time.Since(start); elapsed > 2*time.Second {
+                t.Errorf("slow partial request dropped after %v", elapsed)
+        }
+}
+
+type testCert struct {
+        cert     *x509.Certificate
+        key      *ecdsa.PrivateKey
+        certFile string
+        keyFile  string
+}
+
+func issueCert(t *testing.T, name string, parent *testCert) *testCert {
+        t.Helper()
+        key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+        if err != nil {
+                t.Fatal(err)
+        }
+        template := &x509.Certificate{
+                SerialNumber:          big.NewInt(time.Now().UnixNano()),
+                Subject:               pkix.Name{CommonName: name},
+                NotBefore:             time.Now().Add(-time.Hour),
+                NotAfter:              time.Now().Add(time.Hour),
+                KeyUsage:              x509.KeyUsageDigitalSignature,
+                ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+                IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+                BasicConstraintsValid: true,
+        }
+        signer, issuer := key, template
+        if parent == nil {
+                template.IsCA = true
+                template.KeyUsage |= x509.KeyUsageCertSign
+        } else {
+                signer, issuer = parent.key, parent.cert
+        }
+        der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+        if err != nil {
+                t.Fatal(err)
+        }
+        cert, err := x509.ParseCertificate(der)
+        if err != nil {
+                t.Fatal(err)
+        }
+        keyDER, err := x509.MarshalECPrivateKey(key)
+        if err != nil {
+                t.Fatal(err)
+        }
+        dir := t.TempDir()
+        result := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+        if err := os.WriteFile(result.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+                t.Fatal(err)
+        }
+        if err := os.WriteFile(result.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+                t.Fatal(err)
+        }
+        return result
+}
+
+type logBuffer struct {
+        lock   sync.Mutex
+        buffer bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+        b.lock.Lock()
+        defer b.lock.Unlock()
+        return b.buffer.Write(p)
+}
+
+func (b *logBuffer) String() string {
+        b.lock.Lock()
+        defer b.lock.Unlock()
+        return b.buffer.String()
+}
+
+func startTLSServer(t *testing.T, server *testCert, clientCA string, output io.Writer) *numserver.Server {
+        t.Helper()
+        config, err := numserver.TLSConfig(server.certFile, server.keyFile, clientCA)
+        if err != nil {
+                t.Fatalf("TLS configuration: %v", err)
+        }
+        listener, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatalf("listen: %v", err)
+        }
+        srv := numserver.NewServer(tls.NewListener(listener, config), numserver.Limits{})
+        srv.SetLogOutput(output)
+        go srv.Serve()
+        t.Cleanup(func() { srv.Shutdown(time.Second) })
+        return srv
+}
+
+func dialTLS(t *testing.T, server *numserver.Server, config *tls.Config) *testConn {
+        t.Helper()
+        conn, err := tls.Dial("tcp", server.Addr().String(), config)
+        if err != nil {
+                t.Fatalf("dial TLS: %v", err)
+        }
+        conn.SetDeadline(time.Now().Add(5 * time.Second))
+        t.Cleanup(func() { conn.Close() })
+        return &testConn{Conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(bufio.NewReader(conn))}
+}
+
+func TestTLS(t *testing.T) {
+        log.ProcessLogxiEnv("*=INF")
+        t.Cleanup(func() { log.ProcessLogxiEnv("") })
+        ca := issueCert(t, "test-ca", nil)
+        serverCert := issueCert(t, "server", ca)
+        clientCert := issueCert(t, "tester", ca)
+        roots := x509.NewCertPool()
+        roots.AddCert(ca.cert)
+        server := startTLSServer(t, serverCert, "", io.Discard)
+        conn := dialTLS(t, server, &tls.Config{RootCAs: roots})
+        if resp := conn.roundTrip(t, proto.Request{Number: "112", Digit: "1"}); resp.Status != "ok" || resp.Count != 2 {
+                t.Fatalf("request over TLS = %+v", resp)
+        }
+        if _, err := tls.Dial("tcp", server.Addr().String(), &tls.Config{}); err == nil {
+                t.Fatal("client accepted a certificate from an unknown CA")
+        }
+        logs := &logBuffer{}
+        mutual := startTLSServer(t, serverCert, ca.certFile, logs)
+        keyPair, err := tls.LoadX509KeyPair(clientCert.certFile, clientCert.keyFile)
+        if err != nil {
+                t.Fatal(err)
+        }
+        conn = dialTLS(t, mutual, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{keyPair}})
+        if resp := conn.roundTrip(t, proto.Request{Number: "112", Digit: "2"}); resp.Status != "ok" || resp.Count != 1 {
+                t.Fatalf("request over mutual TLS = %+v", resp)
+        }
+        if !strings.Contains(logs.String(), "tester") {
+                t.Errorf("client CN missing from the server log:\n%s", logs.String())
+        }
+        anonymous, err := tls.Dial("tcp", mutual.Addr().String(), &tls.Config{RootCAs: roots})
+        if err != nil {
+                return
+        }
+        defer anonymous.Close()
+        anonymous.SetDeadline(time.Now().Add(5 * time.Second))
+        json.NewEncoder(anonymous).Encode(proto.Request{Number: "1", Digit: "1"})
+        var resp proto.Response
+        if err := json.NewDecoder(anonymous).Decode(&resp); err == nil {
+                t.Fatalf("client without a certificate got %+v", resp)
+        }
+}
+
+func TestShutdown(t *testing.T) {
+        server := startServer(t, numserver.Limits{})
+        conn := dial(t, server)
+        conn.roundTrip(t, proto.Request{Number: "1", Digit: "1"})
+        start := time.Now()
+        server.Shutdown(5 * time.Second)
+        if elapsed := time.Since(start); elapsed > time.Second {
+                t.Errorf("shutdown took %v with an idle client", elapsed)
+        }
+        var resp proto.Response
+        if err := conn.dec.Decode(&resp); err != io.EOF {
+                t.Fatalf("after shutdown = %+v, %v; want closed", resp, err)
+        }
+        if _, err := net.DialTimeout("tcp", server.Addr().String(), time.Second); err == nil {
+                t.Fatalf("server still accepting after shutdown")
+        }
+}
+
+func TestHTTPGateway(t *testing.T) {
+        server := startServer(t, numserver.Limits{})
+        gateway := httptest.NewServer(server.Handler())
+        defer gateway.Close()
+        tests := []struct {
+                body   string
+                code   int
+                status string
+                count  int
+        }{
+                {`{"number":"1223","digit":"2"}`, http.StatusOK, "ok", 2},
+                {`{"number":"12a","digit":"2"}`, http.StatusOK, "error", 0},
+                {`{"number":"12","digit":"x"}`, http.StatusOK, "error", 0},
+                {`{"number":`, http.StatusBadRequest, "error", 0},
+        }
+        for _, tt := range tests {
+                resp, err := http.Post(gateway.URL+"/count", "application/json", strings.NewReader(tt.body))
+                if err != nil {
+                        t.Fatalf("POST /count: %v", err)
+                }
+                var body proto.Response
+                json.NewDecoder(resp.Body).Decode(&body)
+                resp.Body.Close()
+                if resp.StatusCode != tt.code || body.Status != tt.status || body.Count != tt.count {
+                        t.Errorf("POST %s = %d %+v, want %d status %q count %d", tt.body, resp.StatusCode, body, tt.code, tt.status, tt.count)
+                }
+        }
+        resp, err := http.Get(gateway.URL + "/count")
+        if err != nil {
+                t.Fatalf("GET /count: %v", err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusMethodNotAllowed {
+                t.Errorf("GET /count = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+        }
+}
+
+func TestHTTPGatewayLimits(t *testing.T) {
+        server := startServer(t, numserver.Limits{MaxConns: 1, Rate: 1, IdleTimeout: time.Second, ReadTimeout: 200 * time.Millisecond})
+        listener, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatalf("listen: %v", err)
+        }
+        gateway := server.HTTPServer("", nil)
+        go gateway.Serve(listener)
+        defer gateway.Close()
+        url := "http://" + listener.Addr().String()
+        post := func() int {
+                resp, err := http.Post(url+"/count", "application/json", strings.NewReader(`{"number":"1223","digit":"2"}`))
+                if err != nil {
+                        t.Fatalf("POST /count: %v", err)
+                }
+                resp.Body.Close()
+                return resp.StatusCode
+        }
+        if code := post(); code != http.StatusOK {
+                t.Fatalf("first POST = %d", code)
+        }
+        if code := post(); code != http.StatusTooManyRequests {
+                t.Errorf("second POST = %d, want %d", code, http.StatusTooManyRequests)
+        }
+        conn, _, err := websocket.DefaultDialer.Dial("ws://"+listener.Addr().String()+"/ws", nil)
+        if err != nil {
+                t.Fatalf("dial: %v", err)
+        }
+        defer conn.Close()
+        if code := post(); code != http.StatusServiceUnavailable {
+                t.Errorf("POST with the WebSocket slot taken = %d, want %d", code, http.StatusServiceUnavailable)
+        }
+        extra := dial(t, server)
+        var resp proto.Response
+        if err := extra.dec.Decode(&resp); err != nil || resp.Message != "Too many connections" {
+                t.Fatalf("TCP connection with the WebSocket slot taken = %+v, %v", resp, err)
+        }
+        slow, err := net.Dial("tcp", listener.Addr().String())
+        if err != nil {
+                t.Fatalf("dial: %v", err)
+        }
+        defer slow.Close()
+        io.WriteString(slow, "POST /count HTTP/1.1\r\nHost: test\r\n")
+        slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+        start := time.Now()
+        io.Copy(io.Discard, slow)
+        if elapsed := time.Since(start); elapsed > 2*time.Second {
+                t.Errorf("slow request headers were allowed for %v", elapsed)
+        }
+}
+
+func TestWebSocketGateway(t *testing.T) {
+        server := startServer(t, numserver.Limits{})
+        gateway := httptest.NewServer(server.Handler())
+        defer gateway.Close()
+        conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/ws", nil)
+        if err != nil {
+                t.Fatalf("dial: %v", err)
+        }
+        defer conn.Close()
+        roundTrip := func(message string) proto.Response {
+                if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+                        t.Fatalf("send: %v", err)
+                }
+                var resp proto.Response
+                if err := conn.ReadJSON(&resp); err != nil {
+                        t.Fatalf("receive: %v", err)
+                }
+                return resp
+        }
+        if resp := roundTrip(`{"id":1,"number":"505","digit":"5"}`); resp.ID != 1 || resp.Count != 2 {
+                t.Errorf("count = %+v", resp)
+        }
+        if resp := roundTrip(`not json`); resp.Message != "Malformed request" {
+                t.Errorf("malformed = %+v", resp)
+        }
+        if resp := roundTrip(`{"op":"hello","version":2}`); resp.Version != 2 {
+                t.Errorf("hello = %+v", resp)
+        }
+        if resp := roundTrip(`{"op":"mul","number":"12","operand":"12"}`); resp.Result != "144" {
+                t.Errorf("mul = %+v", resp)
+        }
+}
+
+func TestMetrics(t *testing.T) {
+        server := startServer(t, numserver.Limits{})
+        conn := dial(t, server)
+        conn.roundTrip(t, proto.Request{Number: "11", Digit: "1"})
+        conn.roundTrip(t, proto.Request{Number: "11", Digit: "x"})
+        conn.roundTrip(t, proto.Request{Number: "x", Digit: "1"})
+
+        recorder := httptest.NewRecorder()
+        server.Metrics().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+        body := recorder.Body.String()
+        for _, want := range []string{
+                "lab1_connections_accepted_total 1\n",
+                "lab1_active_clients 1\n",
+                "lab1_requests_total{status=\"ok\"} 1\n",
+                "lab1_requests_total{status=\"error\"} 2\n",
+                "lab1_request_duration_seconds_bucket{le=\"+Inf\"} 3\n",
+                "lab1_request_duration_seconds_count 3\n",
+        } {
+                if !strings.Contains(body, want) {
+                        t.Errorf("metrics output missing %q:\n%s", want, body)
+                }
+        }
+}
+
+func TestUDP(t *testing.T) {
+        server := startServer(t, numserver.Limits{})
+        packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatalf("listen: %v", err)
+        }
+        go server.ServeUDP(packetConn)
+        conn, err := net.Dial("udp", packetConn.LocalAddr().String())
+        if err != nil {
+                t.Fatalf("dial: %v", err)
+        }
+        defer conn.Close()
+        conn.SetDeadline(time.Now().Add(5 * time.Second))
+        buffer := make([]byte, 64*1024)
+        roundTrip := func(datagram string) proto.Response {
+                if _, err := conn.Write([]byte(datagram)); err != nil {
+                        t.Fatalf("send: %v", err)
+                }
+                n, err := conn.Read(buffer)
+                if err != nil {
+                        t.Fatalf("receive: %v", err)
+                }
+                var resp proto.Response
+                if err := json.Unmarshal(buffer[:n], &resp); err != nil {
+                        t.Fatalf("bad reply %q: %v", buffer[:n], err)
+                }
+                return resp
+        }
+        if resp := roundTrip(`{"id":7,"number":"707","digit":"7"}`); resp.ID != 7 || resp.Count != 2 {
+                t.Errorf("count = %+v", resp)
+        }
+        if resp := roundTrip(`{"id":8,"number":"7a","digit":"7"}`); resp.ID != 8 || resp.Message != "Invalid number" {
+                t.Errorf("invalid number = %+v", resp)
+        }
+        if resp := roundTrip(`{"id":9,`); resp.Message != "Malformed request" {
+                t.Errorf("malformed = %+v", resp)
+        }
+        if resp := roundTrip(`{"id":10,"version":2,"op":"sub","number":"5","operand":"8"}`); resp.ID != 10 || resp.Result != "-3" {
+                t.Errorf("sub = %+v", resp)
+        }
+}
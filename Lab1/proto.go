@@ -1,12 +1,321 @@
 package proto
 
+import (
+    "bufio"
+    "bytes"
+    "encoding"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+)
+
+const Version = 2
+
+const (
+    OpHello     = "hello"
+    OpCount     = "count"
+    OpHistogram = "histogram"
+    OpDigitSum  = "digitsum"
+    OpConvert   = "convert"
+    OpAdd       = "add"
+    OpSub       = "sub"
+    OpMul       = "mul"
+    OpDiv       = "div"
+    OpMod       = "mod"
+)
+
 type Request struct {
-    Number string `json:"number"`
-    Digit  string `json:"digit"`
+    ID       uint64 `json:"id,omitempty"`
+    Version  int    `json:"version,omitempty"`
+    Op       string `json:"op,omitempty"`
+    Number   string `json:"number"`
+    Digit    string `json:"digit"`
+    Operand  string `json:"operand,omitempty"`
+    FromBase int    `json:"from_base,omitempty"`
+    ToBase   int    `json:"to_base,omitempty"`
 }
 
 type Response struct {
-    Status  string `json:"status"`
-    Message string `json:"message"`
-    Count   int    `json:"count"`
+    ID        uint64   `json:"id,omitempty"`
+    Status    string   `json:"status"`
+    Message   string   `json:"message"`
+    Count     int      `json:"count"`
+    Result    string   `json:"result,omitempty"`
+    Histogram []int    `json:"histogram,omitempty"`
+    Version   int      `json:"version,omitempty"`
+    Ops       []string `json:"ops,omitempty"`
+}
+
+const (
+    FormatJSON   byte = 'J'
+    FormatBinary byte = 'B'
+)
+
+const MaxFrameSize = 1 << 20
+
+var Magic = []byte("LAB1")
+
+var (
+    ErrMalformed     = errors.New("malformed frame")
+    ErrFrameTooLarge = errors.New("frame too large")
+    ErrNegotiation   = errors.New("framing negotiation failed")
+)
+
+type Codec interface {
+    Encode(v interface{}) error
+    Decode(v interface{}) error
+}
+
+type streamCodec struct {
+    *json.Encoder
+    *json.Decoder
+}
+
+func NewStreamCodec(r io.Reader, w io.Writer) Codec {
+    return streamCodec{json.NewEncoder(w), json.NewDecoder(r)}
+}
+
+type FrameCodec struct {
+    r      io.Reader
+    w      io.Writer
+    format byte
+}
+
+func NewFrameCodec(r io.Reader, w io.Writer, format byte) *FrameCodec {
+    return &FrameCodec{r: r, w: w, format: format}
+}
+
+func (c *FrameCodec) Encode(v interface{}) error {
+    var payload []byte
+    var err error
+    if c.format == FormatBinary {
+        m, ok := v.(encoding.BinaryMarshaler)
+        if !ok {
+            return fmt.Errorf("%T has no binary encoding", v)
+        }
+        payload, err = m.MarshalBinary()
+    } else {
+        payload, err = json.Marshal(v)
+    }
+    if err != nil {
+        return err
+    }
+    return WriteFrame(c.w, payload)
+}
+
+func (c *FrameCodec) Decode(v interface{}) error {
+    payload, err := ReadFrame(c.r)
+    if err == ErrFrameTooLarge {
+        return fmt.Errorf("%w: %v", ErrMalformed, err)
+    }
+    if err != nil {
+        return err
+    }
+    if c.format == FormatBinary {
+        u, ok := v.(encoding.BinaryUnmarshaler)
+        if !ok {
+            return fmt.Errorf("%T has no binary encoding", v)
+        }
+        err = u.UnmarshalBinary(payload)
+    } else {
+        err = json.Unmarshal(payload, v)
+    }
+    if err != nil {
+        return fmt.Errorf("%w: %v", ErrMalformed, err)
+    }
+    return nil
+}
+
+func WriteFrame(w io.Writer, payload []byte) error {
+    if len(payload) > MaxFrameSize {
+        return ErrFrameTooLarge
+    }
+    frame := make([]byte, 4, 4+len(payload))
+    binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+    _, err := w.Write(append(frame, payload...))
+    return err
+}
+
+func ReadFrame(r io.Reader) ([]byte, error) {
+    var header [4]byte
+    if _, err := io.ReadFull(r, header[:]); err != nil {
+        return nil, err
+    }
+    size := binary.BigEndian.Uint32(header[:])
+    if size > MaxFrameSize {
+        if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+            return nil, err
+        }
+        return nil, ErrFrameTooLarge
+    }
+    payload := make([]byte, size)
+    if _, err := io.ReadFull(r, payload); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return nil, err
+    }
+    return payload, nil
+}
+
+func RequestFraming(conn io.ReadWriter, format byte) error {
+    preamble := append(append([]byte{}, Magic...), format)
+    if _, err := conn.Write(preamble); err != nil {
+        return err
+    }
+    ack := make([]byte, len(preamble))
+    if _, err := io.ReadFull(conn, ack); err != nil {
+        return fmt.Errorf("%w: %v", ErrNegotiation, err)
+    }
+    if !bytes.Equal(ack, preamble) {
+        return ErrNegotiation
+    }
+    return nil
+}
+
+func AcceptFraming(r *bufio.Reader, w io.Writer) (byte, bool, error) {
+    first, err := r.Peek(1)
+    if err != nil || first[0] != Magic[0] {
+        return 0, false, nil
+    }
+    preamble := make([]byte, len(Magic)+1)
+    if _, err := io.ReadFull(r, preamble); err != nil {
+        return 0, false, err
+    }
+    format := preamble[len(Magic)]
+    if !bytes.Equal(preamble[:len(Magic)], Magic) || (format != FormatJSON && format != FormatBinary) {
+        return 0, false, ErrNegotiation
+    }
+    if _, err := w.Write(preamble); err != nil {
+        return 0, false, err
+    }
+    return format, true, nil
+}
+
+func (r *Request) MarshalBinary() ([]byte, error) {
+    var b []byte
+    b = binary.AppendUvarint(b, r.ID)
+    b = binary.AppendUvarint(b, uint64(r.Version))
+    b = appendString(b, r.Op)
+    b = appendString(b, r.Number)
+    b = appendString(b, r.Digit)
+    b = appendString(b, r.Operand)
+    b = binary.AppendVarint(b, int64(r.FromBase))
+    b = binary.AppendVarint(b, int64(r.ToBase))
+    return b, nil
+}
+
+func (r *Request) UnmarshalBinary(data []byte) error {
+    d := &decoder{data: data}
+    r.ID = d.uvarint()
+    r.Version = int(d.uvarint())
+    r.Op = d.string()
+    r.Number = d.string()
+    r.Digit = d.string()
+    r.Operand = d.string()
+    r.FromBase = int(d.varint())
+    r.ToBase = int(d.varint())
+    return d.finish()
+}
+
+func (r *Response) MarshalBinary() ([]byte, error) {
+    var b []byte
+    b = binary.AppendUvarint(b, r.ID)
+    b = appendString(b, r.Status)
+    b = appendString(b, r.Message)
+    b = binary.AppendVarint(b, int64(r.Count))
+    b = appendString(b, r.Result)
+    b = binary.AppendUvarint(b, uint64(len(r.Histogram)))
+    for _, count := range r.Histogram {
+        b = binary.AppendVarint(b, int64(count))
+    }
+    b = binary.AppendUvarint(b, uint64(r.Version))
+    b = binary.AppendUvarint(b, uint64(len(r.Ops)))
+    for _, op := range r.Ops {
+        b = appendString(b, op)
+    }
+    return b, nil
+}
+
+func (r *Response) UnmarshalBinary(data []byte) error {
+    d := &decoder{data: data}
+    r.ID = d.uvarint()
+    r.Status = d.string()
+    r.Message = d.string()
+    r.Count = int(d.varint())
+    r.Result = d.string()
+    r.Histogram = nil
+    for n := d.length(); n > 0; n-- {
+        r.Histogram = append(r.Histogram, int(d.varint()))
+    }
+    r.Version = int(d.uvarint())
+    r.Ops = nil
+    for n := d.length(); n > 0; n-- {
+        r.Ops = append(r.Ops, d.string())
+    }
+    return d.finish()
+}
+
+func appendString(b []byte, s string) []byte {
+    b = binary.AppendUvarint(b, uint64(len(s)))
+    return append(b, s...)
+}
+
+type decoder struct {
+    data []byte
+    err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+    if d.err != nil {
+        return 0
+    }
+    v, n := binary.Uvarint(d.data)
+    if n <= 0 {
+        d.err = io.ErrUnexpectedEOF
+        return 0
+    }
+    d.data = d.data[n:]
+    return v
+}
+
+func (d *decoder) varint() int64 {
+    if d.err != nil {
+        return 0
+    }
+    v, n := binary.Varint(d.data)
+    if n <= 0 {
+        d.err = io.ErrUnexpectedEOF
+        return 0
+    }
+    d.data = d.data[n:]
+    return v
+}
+
+func (d *decoder) length() int {
+    n := d.uvarint()
+    if n > uint64(len(d.data)) {
+        d.err = io.ErrUnexpectedEOF
+        return 0
+    }
+    return int(n)
+}
+
+func (d *decoder) string() string {
+    n := d.length()
+    if d.err != nil {
+        return ""
+    }
+    s := string(d.data[:n])
+    d.data = d.data[n:]
+    return s
+}
+
+func (d *decoder) finish() error {
+    if d.err == nil && len(d.data) > 0 {
+        d.err = errors.New("trailing bytes")
+    }
+    return d.err
 }
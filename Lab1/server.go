@@ -1,15 +1,27 @@
 package main
 
 import (
-        "encoding/json"
+        "context"
+        "crypto/ecdsa"
+        "crypto/elliptic"
+        "crypto/rand"
+        "crypto/tls"
+        "crypto/x509"
+        "crypto/x509/pkix"
+        "encoding/pem"
+        "flag"
         "fmt"
         "github.com/mgutz/logxi/v1"
-        "io"
+        "math/big"
         "net"
+        "net/http"
+        "os"
+        "os/signal"
         "strings"
-        "strconv"
         "sync"
-        "lab1/src/proto"
+        "syscall"
+        "time"
+        "lab1/src/numserver"
 )
 
 var mutex sync.Mutex 
@@ -19,86 +31,189 @@ const (
         IPColor     = "\033[1;32m" 
 )
 
-type Client struct {
-        logger log.Logger    
-        conn   *net.TCPConn  
-        enc    *json.Encoder 
-}
+func generateCertificate(args []string) error {
+        flags := flag.NewFlagSet("gencert", flag.ExitOnError)
+        cn := flags.String("cn", "localhost", "certificate common name")
+        hosts := flags.String("hosts", "localhost,127.0.0.1", "comma-separated DNS names and IP addresses")
+        days := flags.Int("days", 365, "validity period in days")
+        certFile := flags.String("cert", "cert.pem", "output certificate file")
+        keyFile := flags.String("key", "key.pem", "output private key file")
+        caCertFile := flags.String("ca-cert", "", "sign with this CA certificate instead of self-signing")
+        caKeyFile := flags.String("ca-key", "", "private key of the signing CA")
+        flags.Parse(args)
 
-func NewClient(conn *net.TCPConn) *Client {
-        return &Client{
-                logger: log.New(fmt.Sprintf("client %s", conn.RemoteAddr().String())),
-                conn:   conn,
-                enc:    json.NewEncoder(conn),
+        key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+        if err != nil {
+                return err
         }
-}
-
-func (client *Client) serve() {
-        defer client.conn.Close()
-        decoder := json.NewDecoder(client.conn)
-        for {
-                var req proto.Request
-                if err := decoder.Decode(&req); err != nil {
-                        if err == io.EOF {
-                                client.logger.Info("client disconnected", "address", client.conn.RemoteAddr().String())
-                                break
-                        }
-                        client.logger.Error("cannot decode message", "reason", err)
-                        break
+        serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+        if err != nil {
+                return err
+        }
+        template := &x509.Certificate{
+                SerialNumber:          serial,
+                Subject:               pkix.Name{CommonName: *cn},
+                NotBefore:             time.Now().Add(-time.Hour),
+                NotAfter:              time.Now().AddDate(0, 0, *days),
+                KeyUsage:              x509.KeyUsageDigitalSignature,
+                ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+                BasicConstraintsValid: true,
+        }
+        for _, host := range strings.Split(*hosts, ",") {
+                if host = strings.TrimSpace(host); host == "" {
+                        continue
+                }
+                if ip := net.ParseIP(host); ip != nil {
+                        template.IPAddresses = append(template.IPAddresses, ip)
+                } else {
+                        template.DNSNames = append(template.DNSNames, host)
                 }
-                client.logger.Info("received request", "number", req.Number, "digit", req.Digit)
-                client.handleRequest(req)
         }
-}
 
-func (client *Client) handleRequest(req proto.Request) {
-        if len(req.Digit) != 1 || !strings.Contains("0123456789", req.Digit) {
-                client.respond("error", "Invalid digit", 0)
-                return
+        parent, signer := template, interface{}(key)
+        if *caCertFile != "" {
+                ca, err := tls.LoadX509KeyPair(*caCertFile, *caKeyFile)
+                if err != nil {
+                        return err
+                }
+                if parent, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+                        return err
+                }
+                signer = ca.PrivateKey
+        } else {
+                template.IsCA = true
+                template.KeyUsage |= x509.KeyUsageCertSign
         }
-        if _, err := strconv.Atoi(req.Number); err != nil {
-                client.respond("error", "Invalid number", 0)
-                return
+        der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+        if err != nil {
+                return err
+        }
+        keyDER, err := x509.MarshalECPrivateKey(key)
+        if err != nil {
+                return err
+        }
+        if err := writePEM(*certFile, "CERTIFICATE", der, 0644); err != nil {
+                return err
         }
-        count := strings.Count(req.Number, req.Digit)
-        client.respond("ok", "", count)
+        return writePEM(*keyFile, "EC PRIVATE KEY", keyDER, 0600)
 }
 
-func (client *Client) respond(status string, message string, count int) {
-        response := proto.Response{
-                Status:  status,
-                Message: message,
-                Count:   count,
-        }
-        if err := client.enc.Encode(response); err != nil {
-                client.logger.Error("cannot send response", "reason", err)
+func writePEM(file, blockType string, der []byte, perm os.FileMode) error {
+        out, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+        if err != nil {
+                return err
         }
+        defer out.Close()
+        return pem.Encode(out, &pem.Block{Type: blockType, Bytes: der})
 }
 
 func main() {
-        addrStr := "185.102.139.169:9742"
         logger := log.New("server")
+        if len(os.Args) > 1 && os.Args[1] == "gencert" {
+                if err := generateCertificate(os.Args[2:]); err != nil {
+                        logger.Error("cannot generate certificate", "reason", err)
+                        os.Exit(1)
+                }
+                return
+        }
+
+        var addrStr, httpAddr, metricsAddr, udpAddr, certFile, keyFile, clientCAFile string
+        var limits numserver.Limits
+        var shutdownTimeout time.Duration
+        flag.StringVar(&addrStr, "addr", "185.102.139.169:9742", "specify IP address and port")
+        flag.StringVar(&httpAddr, "http", "", "also serve POST /count and /ws on this address")
+        flag.StringVar(&udpAddr, "udp", "", "also accept single-datagram requests on this UDP address")
+        flag.StringVar(&metricsAddr, "metrics", "", "serve Prometheus metrics at /metrics on this address")
+        flag.StringVar(&certFile, "tls-cert", "", "serve over TLS with this certificate file")
+        flag.StringVar(&keyFile, "tls-key", "", "private key file for the TLS certificate")
+        flag.StringVar(&clientCAFile, "client-ca", "", "require client certificates signed by this CA file")
+        flag.IntVar(&limits.MaxConns, "max-conns", 0, "maximum number of simultaneous clients (0 = unlimited)")
+        flag.DurationVar(&limits.IdleTimeout, "idle-timeout", 5*time.Minute, "close connections idle for this long (0 = never)")
+        flag.DurationVar(&limits.ReadTimeout, "read-timeout", 10*time.Second, "time allowed to receive a whole request or complete the TLS handshake (0 = unlimited)")
+        flag.Float64Var(&limits.Rate, "rate", 0, "maximum requests per second per client (0 = unlimited)")
+        flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "time to wait for clients to drain on shutdown")
+        flag.Parse()
 
         addr, err := net.ResolveTCPAddr("tcp", addrStr)
         if err != nil {
                 logger.Error("address resolution failed", "address", addrStr, "reason", err)
                 return
         }
-        listener, err := net.ListenTCP("tcp", addr)
+        tcpListener, err := net.ListenTCP("tcp", addr)
         if err != nil {
                 logger.Error("listening failed", "reason", err)
                 return
         }
-        defer listener.Close()
+        var listener net.Listener = tcpListener
+        var tlsConfig *tls.Config
+        if certFile != "" {
+                tlsConfig, err = numserver.TLSConfig(certFile, keyFile, clientCAFile)
+                if err != nil {
+                        logger.Error("cannot load TLS configuration", "reason", err)
+                        tcpListener.Close()
+                        return
+                }
+                listener = tls.NewListener(tcpListener, tlsConfig)
+                logger.Info("TLS enabled", "mutual", clientCAFile != "")
+        }
+        server := numserver.NewServer(listener, limits)
         fmt.Printf("The server started on %s%s%s\n", IPColor, addr.String(), Reset)
         logger.Info("server started", "address", addr.String())
-        for {
-                conn, err := listener.AcceptTCP()
+
+        var gateway *http.Server
+        if httpAddr != "" {
+                gateway = server.HTTPServer(httpAddr, tlsConfig)
+                go func() {
+                        var err error
+                        if tlsConfig != nil {
+                                err = gateway.ListenAndServeTLS("", "")
+                        } else {
+                                err = gateway.ListenAndServe()
+                        }
+                        if err != nil && err != http.ErrServerClosed {
+                                logger.Error("HTTP gateway failed", "reason", err)
+                        }
+                }()
+                fmt.Printf("The HTTP gateway started on %s%s%s\n", IPColor, httpAddr, Reset)
+                logger.Info("HTTP gateway started", "address", httpAddr)
+        }
+
+        if udpAddr != "" {
+                packetConn, err := net.ListenPacket("udp", udpAddr)
                 if err != nil {
-                        logger.Error("cannot accept connection", "reason", err)
-                        continue
+                        logger.Error("UDP listening failed", "reason", err)
+                        return
                 }
-                logger.Info("accepted connection", "address", conn.RemoteAddr().String())
-                go NewClient(conn).serve()
+                go server.ServeUDP(packetConn)
+                fmt.Printf("The UDP listener started on %s%s%s\n", IPColor, packetConn.LocalAddr().String(), Reset)
+                logger.Info("UDP listener started", "address", packetConn.LocalAddr().String())
         }
+
+        if metricsAddr != "" {
+                mux := http.NewServeMux()
+                mux.Handle("/metrics", server.Metrics())
+                go func() {
+                        if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+                                logger.Error("metrics endpoint failed", "reason", err)
+                        }
+                }()
+                logger.Info("metrics endpoint started", "address", metricsAddr)
+        }
+
+        signals := make(chan os.Signal, 1)
+        signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+        stopped := make(chan struct{})
+        go func() {
+                sig := <-signals
+                logger.Info("shutting down", "signal", sig.String())
+                if gateway != nil {
+                        ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+                        gateway.Shutdown(ctx)
+                        cancel()
+                }
+                server.Shutdown(shutdownTimeout)
+                close(stopped)
+        }()
+        server.Serve()
+        <-stopped
 }
@@ -2,4 +2,4 @@ module lab3
 
 go 1.22.0
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require github.com/gorilla/websocket v1.5.3
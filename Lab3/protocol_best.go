@@ -1,469 +1,183 @@
 package main
 
 import (
-	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"html/template"
-	"io"
-	"log"
-	"net"
-	"net/http"
 	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"lab3/src/ring"
 )
 
-type Message struct {
-	ID         string   `json:"id"`
-	Sender     string   `json:"sender"`
-	Recipients []string `json:"recipients"`
-	Content    string   `json:"content"`
-	HopCount   int      `json:"hop_count"`
-	MaxHops    int      `json:"max_hops"`
-	Timestamp  int64    `json:"timestamp"`
-}
-type SendMessageRequest struct {
-	Sender    string `json:"sender"`
-	Recipient string `json:"recipient"`
-	Message   string `json:"message"`
-}
-type PeerInfo struct {
-	Name string
-	IP   string
-	Port string
-}
-
-var (
-	peerName         string
-	ownAddress       string
-	ownPort          string
-	nextPeerAddr     string
-	nextPeerPort     string
-	nextPeerConn     net.Conn
-	listener         net.Listener
-	receivedMessages []Message
-	messageMutex     sync.Mutex
-	logMutex         sync.Mutex
-	consoleMutex     sync.Mutex
-)
-var (
-	upgrader     = websocket.Upgrader{}
-	clients      = make(map[*websocket.Conn]bool)
-	clientsMutex sync.Mutex
-	peerList     = []PeerInfo{
-		{Name: "Peer1", IP: "185.104.251.226", Port: "9651"},
-		{Name: "Peer2", IP: "185.102.139.161", Port: "9651"},
-		{Name: "Peer3", IP: "185.102.139.168", Port: "9651"},
-		{Name: "Peer4", IP: "185.102.139.169", Port: "9651"},
-	}
-)
+type Config struct {
+	Name       string          `json:"name"`
+	Listen     string          `json:"listen"`
+	Bootstrap  []string        `json:"bootstrap"`
+	HTTP       string          `json:"http"`
+	MaxHops    int             `json:"max_hops"`
+	DataDir    string          `json:"data_dir"`
+	Peers      []ring.PeerInfo `json:"peers"`
+	Groups     []string        `json:"groups"`
+	Downloads  string          `json:"downloads"`
+	MailboxTTL string          `json:"mailbox_ttl"`
+	Password   string          `json:"password"`
+	Origins    []string        `json:"allowed_origins"`
+	Transport  string          `json:"transport"`
+	TLSCert    string          `json:"tls_cert"`
+	TLSKey     string          `json:"tls_key"`
+	TLSCA      string          `json:"tls_ca"`
+}
+type addressList []string
 
-func main() {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Print("Name: ")
-	peerNameInput, err := reader.ReadString('\n')
-	if err != nil {
-		fmt.Printf("Error reading Name: %v\n", err)
-		os.Exit(1)
-	}
-	peerName = strings.TrimSpace(peerNameInput)
-	fmt.Print("Enter your IP address and port (ip:port): ")
-	ownAddrInput, err := reader.ReadString('\n')
-	if err != nil {
-		fmt.Printf("Error reading own IP and port: %v\n", err)
-		os.Exit(1)
-	}
-	ownAddr := strings.TrimSpace(ownAddrInput)
-	fmt.Print("Enter next peer IP address and port (ip:port): ")
-	nextPeerAddrPortInput, err := reader.ReadString('\n')
-	if err != nil {
-		fmt.Printf("Error reading next peer IP and port: %v\n", err)
-		os.Exit(1)
-	}
-	nextPeerAddrPort := strings.TrimSpace(nextPeerAddrPortInput)
-	ownAddressPort := strings.Split(ownAddr, ":")
-	if len(ownAddressPort) != 2 {
-		fmt.Println("Invalid own IP address and port format. Expected format ip:port")
-		os.Exit(1)
-	}
-	ownAddress = ownAddressPort[0]
-	ownPort = ownAddressPort[1]
-	nextPeerAddressPort := strings.Split(nextPeerAddrPort, ":")
-	if len(nextPeerAddressPort) != 2 {
-		fmt.Println("Invalid next peer IP address and port format. Expected format ip:port")
-		os.Exit(1)
-	}
-	nextPeerAddr = nextPeerAddressPort[0]
-	nextPeerPort = nextPeerAddressPort[1]
-	initLogging()
-	go startListening()
-	go connectToNextPeer()
-	go startHTTPServer()
-	handleCommands()
-}
-func initLogging() {
-	logFile, err := os.OpenFile(fmt.Sprintf("%s.log", peerName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		fmt.Printf("Failed to open log file: %v\n", err)
-		os.Exit(1)
-	}
-	log.SetOutput(logFile)
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
-	logEvent("Peer %s started. Listening on %s:%s", peerName, ownAddress, ownPort)
+func (list *addressList) String() string {
+	return strings.Join(*list, ",")
 }
-func startListening() {
-	addr := ownAddress + ":" + ownPort
-	var err error
-	listener, err = net.Listen("tcp", addr)
-	if err != nil {
-		logError("Failed to start listening: %v", err)
-		os.Exit(1)
-	}
-	logEvent("Listening for incoming connections on %s", addr)
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			logError("Failed to accept connection: %v", err)
-			continue
-		}
-		logEvent("Accepted connection from %s", conn.RemoteAddr().String())
-		go handleConnection(conn)
-	}
-}
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-	reader := bufio.NewReader(conn)
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err != io.EOF {
-				logError("Error reading from connection: %v", err)
-			}
-			break
-		}
-		var msg Message
-		err = json.Unmarshal(line, &msg)
-		if err != nil {
-			logError("Failed to unmarshal message: %v", err)
-			continue
-		}
-		err = validateMessage(&msg)
-		if err != nil {
-			logError("Invalid message received: %v", err)
-			continue
+func (list *addressList) Set(value string) error {
+	*list = nil
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			*list = append(*list, addr)
 		}
-		receiveMessage(&msg)
 	}
+	return nil
 }
-func validateMessage(msg *Message) error {
-	if msg.ID == "" {
-		return errors.New("message ID is empty")
-	}
-	if msg.Sender == "" {
-		return errors.New("sender is empty")
-	}
-	if len(msg.Recipients) == 0 {
-		return errors.New("recipients list is empty")
-	}
-	if msg.Content == "" {
-		return errors.New("content is empty")
-	}
-	if msg.HopCount < 0 {
-		return errors.New("invalid hop count")
+func loadJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
 	}
-	if msg.MaxHops <= 0 {
-		return errors.New("invalid max hops")
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
 	}
 	return nil
 }
-func receiveMessage(msg *Message) {
-	logEvent("Received message %s from %s", msg.ID, msg.Sender)
-	if msg.HopCount >= msg.MaxHops {
-		logEvent("Message %s reached max hops. Discarding.", msg.ID)
-		return
-	}
-	isRecipient := false
-	for i, recipient := range msg.Recipients {
-		if recipient == peerName {
-			isRecipient = true
-			msg.Recipients = append(msg.Recipients[:i], msg.Recipients[i+1:]...)
-			break
-		}
-	}
-	if isRecipient {
-		messageMutex.Lock()
-		for _, m := range receivedMessages {
-			if m.ID == msg.ID {
-				logEvent("Already received message %s. Discarding.", msg.ID)
-				messageMutex.Unlock()
-				return
-			}
+func loadTLS(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
 		}
-		receivedMessages = append(receivedMessages, *msg)
-		messageMutex.Unlock()
-		logEvent("Message %s is for us. Handling.", msg.ID)
-		consoleMutex.Lock()
-		fmt.Printf("\nReceived message from %s: %s\n", msg.Sender, msg.Content)
-		fmt.Print("Enter command: ")
-		consoleMutex.Unlock()
-		broadcastMessage(fmt.Sprintf("Received message from %s: %s", msg.Sender, msg.Content))
-	}
-	msg.HopCount++
-	if len(msg.Recipients) > 0 {
-		forwardMessage(msg)
-	} else {
-		logEvent("All recipients handled for message %s. Not forwarding.", msg.ID)
+		config.Certificates = []tls.Certificate{cert}
 	}
-}
-func forwardMessage(msg *Message) {
-	if nextPeerConn == nil {
-		connectToNextPeer()
-	}
-	if nextPeerConn != nil {
-		msgBytes, err := json.Marshal(msg)
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
 		if err != nil {
-			logError("Failed to marshal message %s: %v", msg.ID, err)
-			return
+			return nil, err
 		}
-		msgBytes = append(msgBytes, '\n')
-		_, err = nextPeerConn.Write(msgBytes)
-		if err != nil {
-			logError("Failed to forward message %s: %v", msg.ID, err)
-			nextPeerConn.Close()
-			nextPeerConn = nil
-			return
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New(caFile + ": no certificates found")
 		}
-		logEvent("Forwarded message %s to %s:%s", msg.ID, nextPeerAddr, nextPeerPort)
-	} else {
-		logError("No connection to next peer. Cannot forward message %s", msg.ID)
+		config.RootCAs = pool
 	}
+	return config, nil
 }
-func connectToNextPeer() {
-	for {
-		addr := nextPeerAddr + ":" + nextPeerPort
-		conn, err := net.Dial("tcp", addr)
+func main() {
+	config := Config{HTTP: ":9651", MailboxTTL: "1h", Transport: ring.TransportTCP}
+	var configPath, peersPath string
+	flag.StringVar(&configPath, "config", "", "read settings from this JSON file (flags override it)")
+	flag.StringVar(&config.Name, "name", "", "peer name")
+	flag.StringVar(&config.Listen, "listen", "", "IP address and port to listen on for ring peers")
+	flag.Var((*addressList)(&config.Bootstrap), "bootstrap", "comma-separated ring peers to join through, tried in order (empty to start a new ring)")
+	flag.StringVar(&config.HTTP, "http", config.HTTP, "address of the web UI and HTTP API (empty to disable)")
+	flag.IntVar(&config.MaxHops, "max-hops", 10, "maximum number of hops for messages sent by this peer")
+	flag.StringVar(&config.DataDir, "data-dir", "", "directory for the log, keys and message store")
+	flag.Var((*addressList)(&config.Groups), "groups", "comma-separated groups to subscribe to")
+	flag.StringVar(&config.Downloads, "downloads", "", "directory for received files (default <data-dir>/downloads)")
+	flag.StringVar(&config.MailboxTTL, "mailbox-ttl", config.MailboxTTL, "how long to hold messages for peers that are not on the ring")
+	flag.Var((*addressList)(&config.Origins), "allowed-origins", "comma-separated extra origins allowed to open the WebSocket feed")
+	flag.StringVar(&config.Transport, "transport", config.Transport, "transport for ring links: tcp, tls, ws or wss")
+	flag.StringVar(&config.TLSCert, "tls-cert", "", "PEM certificate for the tls and wss transports")
+	flag.StringVar(&config.TLSKey, "tls-key", "", "PEM private key for the tls and wss transports")
+	flag.StringVar(&config.TLSCA, "tls-ca", "", "PEM certificates trusted when dialing tls and wss peers (default system roots)")
+	flag.StringVar(&peersPath, "peers", "", "read the peer directory from this JSON file")
+	flag.Parse()
+	if configPath != "" {
+		set := make(map[string]string)
+		flag.Visit(func(f *flag.Flag) {
+			set[f.Name] = f.Value.String()
+		})
+		err := loadJSON(configPath, &config)
 		if err != nil {
-			logError("Failed to connect to next peer %s:%s: %v. Retrying in 5 seconds.", nextPeerAddr, nextPeerPort, err)
-			time.Sleep(5 * time.Second)
-			continue
+			fmt.Fprintf(os.Stderr, "Failed to read config: %v\n", err)
+			os.Exit(1)
+		}
+		for name, value := range set {
+			flag.Set(name, value)
 		}
-		nextPeerConn = conn
-		logEvent("Connected to next peer %s:%s", nextPeerAddr, nextPeerPort)
-		return
 	}
-}
-func handleCommands() {
-	reader := bufio.NewReader(os.Stdin)
-	for {
-		consoleMutex.Lock()
-		fmt.Print("Enter command: ")
-		consoleMutex.Unlock()
-		cmdLine, err := reader.ReadString('\n')
+	if peersPath != "" {
+		config.Peers = nil
+		err := loadJSON(peersPath, &config.Peers)
 		if err != nil {
-			logError("Failed to read command: %v", err)
-			continue
+			fmt.Fprintf(os.Stderr, "Failed to read peer directory: %v\n", err)
+			os.Exit(1)
 		}
-		cmdLine = strings.TrimSpace(cmdLine)
-		if cmdLine == "" {
-			continue
-		}
-		parts := strings.Fields(cmdLine)
-		if len(parts) == 0 {
-			continue
-		}
-		switch parts[0] {
-		case "send":
-			if len(parts) < 3 {
-				fmt.Println("Usage: send <recipient1,recipient2,...> <message>")
-				continue
-			}
-			recipients := strings.Split(parts[1], ",")
-			content := strings.Join(parts[2:], " ")
-			sendMessage(peerName, recipients, content)
-		case "print":
-			printReceivedMessages()
-		default:
-			fmt.Println("Unknown command. Available commands: send, print")
-		}
-	}
-}
-func sendMessage(sender string, recipients []string, content string) {
-	sendMessageFrom(sender, recipients, content)
-}
-func generateMessageID() string {
-	return fmt.Sprintf("%s-%d", peerName, time.Now().UnixNano())
-}
-func printReceivedMessages() {
-	messageMutex.Lock()
-	defer messageMutex.Unlock()
-	if len(receivedMessages) == 0 {
-		fmt.Println("No messages received.")
-		return
-	}
-	fmt.Println("Received messages:")
-	for _, msg := range receivedMessages {
-		fmt.Printf("From: %s; Content: %s\n", msg.Sender, msg.Content)
-	}
-}
-func logEvent(format string, v ...interface{}) {
-	logMutex.Lock()
-	defer logMutex.Unlock()
-	log.Printf("EVENT: "+format, v...)
-}
-func logError(format string, v ...interface{}) {
-	logMutex.Lock()
-	defer logMutex.Unlock()
-	log.Printf("ERROR: "+format, v...)
-}
-func startHTTPServer() {
-	http.HandleFunc("/", serveHome)
-	http.HandleFunc("/ws", handleWebSocket)
-	http.HandleFunc("/send", handleSendMessage)
-	logEvent("Starting HTTP server on port 9651")
-	err := http.ListenAndServe(":9651", nil)
-	if err != nil {
-		logError("HTTP server error: %v", err)
 	}
-}
-func serveHome(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := template.ParseFiles("index.html")
-	if err != nil {
-		logError("Failed to parse index.html: %v", err)
-		http.Error(w, "Internal Server Error", 500)
-		return
+	if config.Name == "" || config.Listen == "" {
+		fmt.Fprintln(os.Stderr, "Peer name and listen address are required (-name, -listen or -config)")
+		flag.Usage()
+		os.Exit(2)
 	}
-	err = tmpl.Execute(w, nil)
-	if err != nil {
-		logError("Failed to execute template: %v", err)
-		http.Error(w, "Internal Server Error", 500)
+	mailboxTTL, err := time.ParseDuration(config.MailboxTTL)
+	if err != nil || mailboxTTL <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid mailbox TTL %q\n", config.MailboxTTL)
+		os.Exit(2)
 	}
-}
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	conn, err := upgrader.Upgrade(w, r, nil)
+	tlsConfig, err := loadTLS(config.TLSCert, config.TLSKey, config.TLSCA)
 	if err != nil {
-		logError("WebSocket upgrade error: %v", err)
-		return
+		fmt.Fprintf(os.Stderr, "Failed to load TLS settings: %v\n", err)
+		os.Exit(2)
 	}
-	defer conn.Close()
-	clientsMutex.Lock()
-	clients[conn] = true
-	clientsMutex.Unlock()
-	logEvent("WebSocket client connected: %s", conn.RemoteAddr().String())
-	for {
-		_, _, err := conn.ReadMessage()
+	if config.DataDir != "" {
+		err := os.MkdirAll(config.DataDir, 0755)
 		if err != nil {
-			clientsMutex.Lock()
-			delete(clients, conn)
-			clientsMutex.Unlock()
-			logEvent("WebSocket client disconnected: %s", conn.RemoteAddr().String())
-			break
-		}
-	}
-}
-func handleSendMessage(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
-		handleSendMessagePost(w, r)
-	} else if r.Method == http.MethodGet {
-		handleSendMessageGet(w, r)
-	} else {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-	}
-}
-func handleSendMessagePost(w http.ResponseWriter, r *http.Request) {
-	var req SendMessageRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+			fmt.Fprintf(os.Stderr, "Failed to create data directory: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	peer, err := ring.NewPeer(ring.Options{
+		Name:           config.Name,
+		Address:        config.Listen,
+		Bootstrap:      config.Bootstrap,
+		HTTPAddress:    config.HTTP,
+		MaxHops:        config.MaxHops,
+		Dir:            config.DataDir,
+		Peers:          config.Peers,
+		Groups:         config.Groups,
+		DownloadDir:    config.Downloads,
+		MailboxTTL:     mailboxTTL,
+		Password:       config.Password,
+		AllowedOrigins: config.Origins,
+		Transport:      config.Transport,
+		TLSConfig:      tlsConfig,
+		Output:         os.Stdout,
+	})
 	if err != nil {
-		logError("Failed to decode send message request: %v", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
-		return
-	}
-	if req.Sender == "" || req.Recipient == "" || req.Message == "" {
-		http.Error(w, "Missing sender, recipient or message", http.StatusBadRequest)
-		return
-	}
-	validSender := false
-	validRecipient := false
-	for _, peer := range peerList {
-		if peer.Name == req.Sender {
-			validSender = true
-		}
-		if peer.Name == req.Recipient {
-			validRecipient = true
-		}
-	}
-	if !validSender {
-		http.Error(w, "Invalid sender name", http.StatusBadRequest)
-		return
-	}
-	if !validRecipient {
-		http.Error(w, "Invalid recipient name", http.StatusBadRequest)
-		return
-	}
-	sendMessageFrom(req.Sender, []string{req.Recipient}, req.Message)
-	w.Header().Set("Content-Type", "application/json")
-	resp := map[string]string{"status": "success"}
-	json.NewEncoder(w).Encode(resp)
-}
-func handleSendMessageGet(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
-	sender := query.Get("from")
-	recipient := query.Get("to")
-	message := query.Get("msg")
-	if sender == "" || recipient == "" || message == "" {
-		http.Error(w, "Missing 'from', 'to' or 'msg' query parameters", http.StatusBadRequest)
-		return
-	}
-	validSender := false
-	validRecipient := false
-	for _, peer := range peerList {
-		if peer.Name == sender {
-			validSender = true
-		}
-		if peer.Name == recipient {
-			validRecipient = true
-		}
-	}
-	if !validSender {
-		http.Error(w, "Invalid sender name", http.StatusBadRequest)
-		return
-	}
-	if !validRecipient {
-		http.Error(w, "Invalid recipient name", http.StatusBadRequest)
-		return
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	sendMessageFrom(sender, []string{recipient}, message)
-	w.Header().Set("Content-Type", "application/json")
-	resp := map[string]string{"status": "success"}
-	json.NewEncoder(w).Encode(resp)
-}
-func sendMessageFrom(sender string, recipients []string, content string) {
-	msg := Message{
-		ID:         generateMessageID(),
-		Sender:     sender,
-		Recipients: recipients,
-		Content:    content,
-		HopCount:   0,
-		MaxHops:    10,
-		Timestamp:  time.Now().Unix(),
+	err = peer.Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	logEvent("Sending message %s from %s to %v", msg.ID, sender, recipients)
-	forwardMessage(&msg)
-}
-func broadcastMessage(message string) {
-	clientsMutex.Lock()
-	defer clientsMutex.Unlock()
-	for client := range clients {
-		err := client.WriteMessage(websocket.TextMessage, []byte(message))
-		if err != nil {
-			logError("WebSocket send error: %v", err)
-			client.Close()
-			delete(clients, client)
-		}
+	fmt.Printf("Peer %s listening on %s\n", peer.Name(), peer.Addr())
+	if !peer.RunConsole(os.Stdin) {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		peer.Leave()
 	}
+	peer.Stop()
 }
@@ -0,0 +1,3183 @@
+package ring
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type Message struct {
+	ID         string              `json:"id"`
+	Type       string              `json:"type,omitempty"`
+	Sender     string              `json:"sender"`
+	Recipients []string            `json:"recipients"`
+	Content    string              `json:"content"`
+	HopCount   int                 `json:"hop_count"`
+	MaxHops    int                 `json:"max_hops"`
+	Timestamp  int64               `json:"timestamp"`
+	Address    string              `json:"address,omitempty"`
+	Origin     string              `json:"origin,omitempty"`
+	Successors []string            `json:"successors,omitempty"`
+	Members    map[string]string   `json:"members,omitempty"`
+	ReplyTo    string              `json:"reply_to,omitempty"`
+	AckFor     string              `json:"ack_for,omitempty"`
+	Keys       map[string]PeerKeys `json:"keys,omitempty"`
+	Ephemeral  []byte              `json:"ephemeral,omitempty"`
+	Wrapped    map[string]string   `json:"wrapped,omitempty"`
+	Signer     string              `json:"signer,omitempty"`
+	Signature  []byte              `json:"signature,omitempty"`
+	File       *FileChunk          `json:"file,omitempty"`
+	Nodes      []NodeInfo          `json:"nodes,omitempty"`
+	Reverse    bool                `json:"reverse,omitempty"`
+	Clock      uint64              `json:"clock,omitempty"`
+	Departed   string              `json:"departed,omitempty"`
+}
+type FileChunk struct {
+	Transfer string `json:"transfer"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Seq      int    `json:"seq"`
+	Total    int    `json:"total"`
+	Checksum string `json:"checksum"`
+}
+type NodeInfo struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	Uptime    int64  `json:"uptime"`
+	Queue     int    `json:"queue"`
+	Successor string `json:"successor"`
+}
+type Topology struct {
+	ID      string     `json:"id"`
+	Time    int64      `json:"time"`
+	Status  string     `json:"status"`
+	Problem string     `json:"problem,omitempty"`
+	Nodes   []NodeInfo `json:"nodes"`
+	Missing []string   `json:"missing,omitempty"`
+}
+type session struct {
+	csrf    string
+	expires time.Time
+}
+type SessionInfo struct {
+	Name string `json:"name"`
+	User string `json:"user"`
+	CSRF string `json:"csrf,omitempty"`
+}
+type userKey struct{}
+type heldMessage struct {
+	msg     Message
+	expires time.Time
+}
+type outgoingTransfer struct {
+	name       string
+	total      int
+	recipients []string
+	acked      map[string]int
+	failed     map[string]bool
+}
+type incomingTransfer struct {
+	name     string
+	sender   string
+	size     int64
+	total    int
+	checksum string
+	chunks   map[int][]byte
+	received int64
+	updated  time.Time
+}
+type PeerKeys struct {
+	Sign ed25519.PublicKey `json:"sign"`
+	Box  []byte            `json:"box"`
+}
+type keyFile struct {
+	Sign []byte `json:"sign"`
+	Box  []byte `json:"box"`
+}
+type SentMessage struct {
+	Message  Message           `json:"message"`
+	Status   map[string]string `json:"status"`
+	Attempts int               `json:"attempts"`
+	LastSent time.Time         `json:"last_sent"`
+	wire     Message
+	transfer string
+}
+type StoredMessage struct {
+	Direction string  `json:"direction"`
+	Stored    int64   `json:"stored"`
+	Message   Message `json:"message"`
+}
+type HistoryFilter struct {
+	Sender string
+	Since  int64
+	Until  int64
+	Page   int
+	Size   int
+}
+type HistoryPage struct {
+	Total    int             `json:"total"`
+	Page     int             `json:"page"`
+	Size     int             `json:"size"`
+	Messages []StoredMessage `json:"messages"`
+}
+type ChatEntry struct {
+	Direction string            `json:"direction"`
+	Message   Message           `json:"message"`
+	Status    map[string]string `json:"status,omitempty"`
+}
+type ChatPage struct {
+	Total    int         `json:"total"`
+	Page     int         `json:"page"`
+	Size     int         `json:"size"`
+	Messages []ChatEntry `json:"messages"`
+}
+type Event struct {
+	Type      string   `json:"type"`
+	Time      int64    `json:"time"`
+	Peer      string   `json:"peer"`
+	Message   *Message `json:"message,omitempty"`
+	ID        string   `json:"id,omitempty"`
+	Recipient string   `json:"recipient,omitempty"`
+	Status    string   `json:"status,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Address   string   `json:"address,omitempty"`
+	State     string   `json:"state,omitempty"`
+	Text      string   `json:"text,omitempty"`
+}
+type RingMember struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	Self      bool   `json:"self"`
+	Successor bool   `json:"successor"`
+}
+type RingStatus struct {
+	Name               string       `json:"name"`
+	Address            string       `json:"address"`
+	Successors         []string     `json:"successors"`
+	SuccessorConnected bool         `json:"successor_connected"`
+	Predecessor        string       `json:"predecessor"`
+	Order              []string     `json:"order"`
+	Members            []RingMember `json:"members"`
+	Groups             []string     `json:"groups"`
+}
+
+const (
+	MessageTypeChat          = "chat"
+	MessageTypeJoin          = "join"
+	MessageTypeWelcome       = "welcome"
+	MessageTypeJoined        = "joined"
+	MessageTypeLeave         = "leave"
+	MessageTypeGetSuccessors = "get_successors"
+	MessageTypeSuccessors    = "successors"
+	MessageTypeAck           = "ack"
+	MessageTypeFileChunk     = "file_chunk"
+	MessageTypeProbe         = "probe"
+	MessageTypeProbeReport   = "probe_report"
+	MessageTypeQueued        = "queued"
+	MessageTypeExpired       = "expired"
+)
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliveryQueued    = "queued"
+	DeliveryExpired   = "expired"
+)
+const (
+	DirectionReceived = "received"
+	DirectionSent     = "sent"
+)
+const (
+	EventMessageReceived  = "message_received"
+	EventMessageSent      = "message_sent"
+	EventMessageForwarded = "message_forwarded"
+	EventDeliveryStatus   = "delivery_status"
+	EventFileProgress     = "file_progress"
+	EventPeerJoined       = "peer_joined"
+	EventPeerLeft         = "peer_left"
+	EventSuccessorState   = "successor_state"
+)
+const (
+	TopologyComplete = "complete"
+	TopologySplit    = "split"
+	TopologyBroken   = "broken"
+)
+const (
+	SuccessorConnected    = "connected"
+	SuccessorDisconnected = "disconnected"
+)
+const (
+	BroadcastAddress = "*"
+	GroupPrefix      = "#"
+)
+const (
+	successorListSize = 3
+	controlMaxHops    = 100
+	dialTimeout       = 3 * time.Second
+	defaultStabilize  = 5 * time.Second
+	defaultAckTimeout = 5 * time.Second
+	defaultMailboxTTL = time.Hour
+	defaultMaxHops    = 10
+	maxDeliveries     = 3
+	seenTTL           = 10 * time.Minute
+	transferTimeout   = 10 * time.Minute
+	orderMaxAge       = 10 * time.Minute
+	historyPageSize   = 20
+	fileChunkSize     = 32 * 1024
+	maxFileSize       = 64 * 1024 * 1024
+	probeTimeout      = 5 * time.Second
+	sessionTTL        = 24 * time.Hour
+	eventQueueSize    = 256
+	eventWriteTimeout = 5 * time.Second
+	sessionCookie     = "ring_session"
+	csrfHeader        = "X-CSRF-Token"
+)
+
+var (
+	errNotLoggedIn = errors.New("login required")
+	errBadCSRF     = errors.New("missing or invalid CSRF token")
+)
+
+type SendMessageRequest struct {
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient"`
+	Message   string `json:"message"`
+}
+type PeerInfo struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	Port string `json:"port"`
+}
+type Options struct {
+	Name              string
+	Address           string
+	Bootstrap         []string
+	HTTPAddress       string
+	MaxHops           int
+	Dir               string
+	Peers             []PeerInfo
+	Output            io.Writer
+	Groups            []string
+	DownloadDir       string
+	StabilizeInterval time.Duration
+	AckTimeout        time.Duration
+	MailboxTTL        time.Duration
+	Password          string
+	AllowedOrigins    []string
+	Transport         string
+	TLSConfig         *tls.Config
+}
+type Peer struct {
+	name             string
+	address          string
+	options          Options
+	output           io.Writer
+	logger           *log.Logger
+	logFile          *os.File
+	transport        Transport
+	listener         net.Listener
+	httpServer       *http.Server
+	done             chan struct{}
+	wg               sync.WaitGroup
+	conns            map[net.Conn]struct{}
+	connMutex        sync.Mutex
+	successors       []string
+	successorConn    net.Conn
+	successorAddr    string
+	predecessor      string
+	predecessorConn  net.Conn
+	predecessorAddr  string
+	order            []string
+	orderStale       bool
+	orderUpdated     time.Time
+	members          map[string]string
+	ringMutex        sync.Mutex
+	sendMutex        sync.Mutex
+	sendEvents       []Event
+	receivedMessages []Message
+	sentMessages     map[string]*SentMessage
+	sentOrder        []string
+	sentMutex        sync.Mutex
+	messageMutex     sync.Mutex
+	seenMessages     map[string]time.Time
+	seenMutex        sync.Mutex
+	storeFile        *os.File
+	history          []StoredMessage
+	storeMutex       sync.Mutex
+	signKey          ed25519.PrivateKey
+	boxKey           *ecdh.PrivateKey
+	peerKeys         map[string]PeerKeys
+	consoleMutex     sync.Mutex
+	upgrader         websocket.Upgrader
+	clients          map[*websocket.Conn]chan []byte
+	clientsMutex     sync.Mutex
+	peers            []PeerInfo
+	groups           map[string]bool
+	groupMutex       sync.Mutex
+	outgoing         map[string]*outgoingTransfer
+	incoming         map[string]*incomingTransfer
+	transferMutex    sync.Mutex
+	started          time.Time
+	probes           map[string]chan Message
+	probeMutex       sync.Mutex
+	mailbox          map[string][]heldMessage
+	mailboxMutex     sync.Mutex
+	clock            uint64
+	clockMutex       sync.Mutex
+	password         string
+	sessions         map[string]*session
+	tokens           map[string]string
+	authMutex        sync.Mutex
+}
+
+func NewPeer(options Options) (*Peer, error) {
+	if options.Name == "" {
+		return nil, errors.New("peer name is empty")
+	}
+	if _, _, err := net.SplitHostPort(options.Address); err != nil {
+		return nil, fmt.Errorf("invalid peer address %q: %v", options.Address, err)
+	}
+	for _, addr := range options.Bootstrap {
+		if _, _, err := splitAddress(addr); err != nil {
+			return nil, fmt.Errorf("invalid ring peer address %q: %v", addr, err)
+		}
+	}
+	transport, err := NewTransport(options.Transport, options.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	if options.MaxHops <= 0 {
+		options.MaxHops = defaultMaxHops
+	}
+	if options.StabilizeInterval <= 0 {
+		options.StabilizeInterval = defaultStabilize
+	}
+	if options.AckTimeout <= 0 {
+		options.AckTimeout = defaultAckTimeout
+	}
+	if options.MailboxTTL <= 0 {
+		options.MailboxTTL = defaultMailboxTTL
+	}
+	if options.Output == nil {
+		options.Output = io.Discard
+	}
+	if options.DownloadDir == "" {
+		options.DownloadDir = filepath.Join(options.Dir, "downloads")
+	}
+	for _, group := range options.Groups {
+		if _, err := normalizeGroup(group); err != nil {
+			return nil, err
+		}
+	}
+	peer := &Peer{
+		name:         options.Name,
+		options:      options,
+		output:       options.Output,
+		done:         make(chan struct{}),
+		conns:        make(map[net.Conn]struct{}),
+		members:      make(map[string]string),
+		orderStale:   true,
+		sentMessages: make(map[string]*SentMessage),
+		seenMessages: make(map[string]time.Time),
+		peerKeys:     make(map[string]PeerKeys),
+		clients:      make(map[*websocket.Conn]chan []byte),
+		peers:        options.Peers,
+		groups:       make(map[string]bool),
+		outgoing:     make(map[string]*outgoingTransfer),
+		incoming:     make(map[string]*incomingTransfer),
+		probes:       make(map[string]chan Message),
+		mailbox:      make(map[string][]heldMessage),
+		transport:    transport,
+		password:     options.Password,
+		sessions:     make(map[string]*session),
+		tokens:       make(map[string]string),
+	}
+	peer.upgrader.CheckOrigin = peer.checkOrigin
+	for _, group := range options.Groups {
+		peer.Subscribe(group)
+	}
+	return peer, nil
+}
+func (peer *Peer) Name() string {
+	return peer.name
+}
+func (peer *Peer) Addr() string {
+	return peer.address
+}
+func (peer *Peer) Start() error {
+	logFile, err := os.OpenFile(peer.path("log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	peer.logFile = logFile
+	peer.logger = log.New(logFile, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+	listener, err := peer.transport.Listen(peer.options.Address)
+	if err != nil {
+		logFile.Close()
+		return fmt.Errorf("failed to start listening: %v", err)
+	}
+	peer.listener = listener
+	host, port, _ := net.SplitHostPort(peer.options.Address)
+	if port == "0" {
+		_, port, _ = net.SplitHostPort(listener.Addr().String())
+	}
+	peer.address = joinAddress(peer.options.Transport, net.JoinHostPort(host, port))
+	peer.started = time.Now()
+	peer.members[peer.name] = peer.address
+	peer.logEvent("Peer %s started. Listening on %s", peer.name, peer.address)
+	if err := peer.loadKeys(); err != nil {
+		peer.Stop()
+		return fmt.Errorf("failed to load peer keys: %v", err)
+	}
+	if err := peer.openStore(); err != nil {
+		peer.Stop()
+		return fmt.Errorf("failed to open message store: %v", err)
+	}
+	if err := peer.loadTokens(); err != nil {
+		peer.Stop()
+		return fmt.Errorf("failed to load API tokens: %v", err)
+	}
+	peer.wg.Add(1)
+	go peer.acceptLoop()
+	if len(peer.options.Bootstrap) > 0 {
+		var err error
+		for _, addr := range peer.options.Bootstrap {
+			err = peer.joinRing(addr)
+			if err == nil {
+				break
+			}
+			peer.logError("Failed to join ring via %s: %v", addr, err)
+		}
+		if err != nil {
+			peer.Stop()
+			return fmt.Errorf("failed to join ring via %s: %v", strings.Join(peer.options.Bootstrap, ", "), err)
+		}
+	}
+	peer.runEvery(peer.options.StabilizeInterval, peer.stabilize)
+	peer.runEvery(peer.options.StabilizeInterval, peer.refreshOrder)
+	peer.runEvery(time.Second, peer.retransmitPending)
+	peer.runEvery(time.Second, peer.expireMailbox)
+	peer.runEvery(time.Minute, peer.expireSeen)
+	peer.runEvery(time.Minute, peer.expireTransfers)
+	if peer.options.HTTPAddress != "" {
+		if peer.password == "" {
+			peer.password = randomToken()[:16]
+			fmt.Fprintf(peer.output, "Web UI login: %s, password: %s\n", peer.name, peer.password)
+		}
+		peer.startHTTPServer()
+	}
+	return nil
+}
+func (peer *Peer) Stop() {
+	select {
+	case <-peer.done:
+		return
+	default:
+	}
+	close(peer.done)
+	if peer.listener != nil {
+		peer.listener.Close()
+	}
+	if peer.httpServer != nil {
+		peer.httpServer.Close()
+	}
+	peer.connMutex.Lock()
+	for conn := range peer.conns {
+		conn.Close()
+	}
+	peer.connMutex.Unlock()
+	peer.sendMutex.Lock()
+	if peer.successorConn != nil {
+		peer.successorConn.Close()
+		peer.successorConn = nil
+	}
+	if peer.predecessorConn != nil {
+		peer.predecessorConn.Close()
+		peer.predecessorConn = nil
+	}
+	peer.sendMutex.Unlock()
+	peer.wg.Wait()
+	peer.storeMutex.Lock()
+	if peer.storeFile != nil {
+		peer.storeFile.Close()
+		peer.storeFile = nil
+	}
+	peer.storeMutex.Unlock()
+	peer.logEvent("Peer %s stopped", peer.name)
+	peer.logFile.Close()
+}
+func (peer *Peer) Leave() {
+	peer.leaveRing()
+}
+func (peer *Peer) Send(recipients []string, content string) string {
+	return peer.sendMessageFrom(peer.name, recipients, content)
+}
+func (peer *Peer) Received() []Message {
+	peer.messageMutex.Lock()
+	defer peer.messageMutex.Unlock()
+	return append([]Message(nil), peer.receivedMessages...)
+}
+func (peer *Peer) Sent() []SentMessage {
+	peer.sentMutex.Lock()
+	defer peer.sentMutex.Unlock()
+	list := make([]SentMessage, 0, len(peer.sentOrder))
+	for _, id := range peer.sentOrder {
+		sent := *peer.sentMessages[id]
+		sent.Status = make(map[string]string, len(peer.sentMessages[id].Status))
+		for recipient, status := range peer.sentMessages[id].Status {
+			sent.Status[recipient] = status
+		}
+		list = append(list, sent)
+	}
+	return list
+}
+func (peer *Peer) Successors() []string {
+	return peer.getSuccessors()
+}
+func (peer *Peer) Subscribe(group string) error {
+	group, err := normalizeGroup(group)
+	if err != nil {
+		return err
+	}
+	peer.groupMutex.Lock()
+	peer.groups[group] = true
+	peer.groupMutex.Unlock()
+	return nil
+}
+func (peer *Peer) Unsubscribe(group string) error {
+	group, err := normalizeGroup(group)
+	if err != nil {
+		return err
+	}
+	peer.groupMutex.Lock()
+	delete(peer.groups, group)
+	peer.groupMutex.Unlock()
+	return nil
+}
+func (peer *Peer) Groups() []string {
+	peer.groupMutex.Lock()
+	defer peer.groupMutex.Unlock()
+	list := make([]string, 0, len(peer.groups))
+	for group := range peer.groups {
+		list = append(list, group)
+	}
+	sort.Strings(list)
+	return list
+}
+func (peer *Peer) subscribed(addr string) bool {
+	if addr == BroadcastAddress {
+		return true
+	}
+	peer.groupMutex.Lock()
+	defer peer.groupMutex.Unlock()
+	return peer.groups[addr]
+}
+func normalizeGroup(group string) (string, error) {
+	name := strings.TrimPrefix(group, GroupPrefix)
+	if name == "" || strings.ContainsAny(name, ", "+BroadcastAddress+GroupPrefix) {
+		return "", fmt.Errorf("invalid group name %q", group)
+	}
+	return GroupPrefix + name, nil
+}
+func isGroupAddress(addr string) bool {
+	return addr == BroadcastAddress || strings.HasPrefix(addr, GroupPrefix)
+}
+func (peer *Peer) path(extension string) string {
+	return filepath.Join(peer.options.Dir, fmt.Sprintf("%s.%s", peer.name, extension))
+}
+func (peer *Peer) runEvery(interval time.Duration, task func()) {
+	peer.wg.Add(1)
+	go func() {
+		defer peer.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-peer.done:
+				return
+			case <-ticker.C:
+				task()
+			}
+		}
+	}()
+}
+func (peer *Peer) stopping() bool {
+	select {
+	case <-peer.done:
+		return true
+	default:
+		return false
+	}
+}
+func (peer *Peer) selfAddr() string {
+	return peer.address
+}
+func (peer *Peer) acceptLoop() {
+	defer peer.wg.Done()
+	peer.logEvent("Listening for incoming connections on %s", peer.address)
+	for {
+		conn, err := peer.listener.Accept()
+		if err != nil {
+			if peer.stopping() {
+				return
+			}
+			peer.logError("Failed to accept connection: %v", err)
+			continue
+		}
+		peer.logEvent("Accepted connection from %s", conn.RemoteAddr().String())
+		peer.connMutex.Lock()
+		peer.conns[conn] = struct{}{}
+		peer.connMutex.Unlock()
+		peer.wg.Add(1)
+		go func() {
+			defer peer.wg.Done()
+			peer.handleConnection(conn)
+			peer.connMutex.Lock()
+			delete(peer.conns, conn)
+			peer.connMutex.Unlock()
+		}()
+	}
+}
+
+func (peer *Peer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF && !peer.stopping() {
+				peer.logError("Error reading from connection: %v", err)
+			}
+			break
+		}
+		var msg Message
+		err = json.Unmarshal(line, &msg)
+		if err != nil {
+			peer.logError("Failed to unmarshal message: %v", err)
+			continue
+		}
+		err = peer.validateMessage(&msg)
+		if err != nil {
+			peer.logError("Invalid message received: %v", err)
+			continue
+		}
+		reply := peer.dispatchMessage(&msg)
+		if reply != nil {
+			peer.signMessage(reply)
+			err = writeMessage(conn, reply)
+			if err != nil {
+				peer.logError("Failed to reply to %s: %v", conn.RemoteAddr().String(), err)
+				break
+			}
+		}
+	}
+}
+func (peer *Peer) dispatchMessage(msg *Message) *Message {
+	switch msg.Type {
+	case MessageTypeJoin:
+		return peer.handleJoin(msg)
+	case MessageTypeGetSuccessors:
+		if msg.Address != "" {
+			peer.setPredecessor(msg.Address)
+		}
+		return &Message{
+			ID:         peer.generateMessageID(),
+			Type:       MessageTypeSuccessors,
+			Sender:     peer.name,
+			Address:    peer.selfAddr(),
+			Successors: peer.getSuccessors(),
+		}
+	case MessageTypeJoined:
+		peer.handleJoined(msg)
+	case MessageTypeLeave:
+		peer.handleLeave(msg)
+	case MessageTypeAck:
+		peer.handleAck(msg)
+	case MessageTypeProbe:
+		peer.handleProbe(msg)
+	case MessageTypeProbeReport:
+		peer.handleProbeReport(msg)
+	case MessageTypeQueued, MessageTypeExpired:
+		peer.handleMailboxNotice(msg)
+	default:
+		peer.receiveMessage(msg)
+	}
+	return nil
+}
+func (peer *Peer) validateMessage(msg *Message) error {
+	if msg.ID == "" {
+		return errors.New("message ID is empty")
+	}
+	if msg.Sender == "" {
+		return errors.New("sender is empty")
+	}
+	switch msg.Type {
+	case "", MessageTypeChat, MessageTypeFileChunk:
+		if msg.Type == MessageTypeFileChunk {
+			if msg.File == nil || msg.File.Transfer == "" || msg.File.Name == "" {
+				return errors.New("file chunk without file description")
+			}
+			if msg.File.Name == "." || msg.File.Name == ".." || strings.ContainsAny(msg.File.Name, `/\`) {
+				return fmt.Errorf("invalid file name %q", msg.File.Name)
+			}
+			if msg.File.Total <= 0 || msg.File.Seq < 0 || msg.File.Seq >= msg.File.Total || msg.File.Size < 0 || msg.File.Size > maxFileSize {
+				return errors.New("invalid file chunk sequence")
+			}
+			if msg.File.Total != chunkCount(msg.File.Size) {
+				return errors.New("file chunk count does not match file size")
+			}
+		}
+		if len(msg.Recipients) == 0 {
+			return errors.New("recipients list is empty")
+		}
+		if msg.Content == "" {
+			return errors.New("content is empty")
+		}
+		if len(msg.Ephemeral) == 0 || len(msg.Wrapped) == 0 {
+			return errors.New("content is not encrypted")
+		}
+		for _, recipient := range msg.Recipients {
+			if isGroupAddress(recipient) && (len(msg.Recipients) != 1 || msg.Origin == "") {
+				return errors.New("group address must be the only recipient")
+			}
+		}
+		if msg.HopCount < 0 {
+			return errors.New("invalid hop count")
+		}
+		if msg.MaxHops <= 0 {
+			return errors.New("invalid max hops")
+		}
+	case MessageTypeJoin, MessageTypeJoined:
+		if msg.Address == "" {
+			return errors.New("peer address is empty")
+		}
+		if _, ok := msg.Keys[msg.Sender]; !ok {
+			return errors.New("public key of joining peer is missing")
+		}
+	case MessageTypeLeave:
+		if msg.Address == "" {
+			return errors.New("peer address is empty")
+		}
+		if msg.Departed == "" {
+			return errors.New("departed peer is empty")
+		}
+	case MessageTypeGetSuccessors:
+	case MessageTypeAck:
+		if msg.AckFor == "" {
+			return errors.New("acknowledged message ID is empty")
+		}
+		if len(msg.Recipients) == 0 {
+			return errors.New("recipients list is empty")
+		}
+	case MessageTypeQueued, MessageTypeExpired:
+		if msg.AckFor == "" {
+			return errors.New("message ID is empty")
+		}
+		if msg.Content == "" {
+			return errors.New("recipient name is empty")
+		}
+		if len(msg.Recipients) == 0 {
+			return errors.New("recipients list is empty")
+		}
+	case MessageTypeProbe:
+		if msg.Origin == "" {
+			return errors.New("probe origin is empty")
+		}
+		if msg.MaxHops <= 0 {
+			return errors.New("invalid max hops")
+		}
+	case MessageTypeProbeReport:
+		if msg.AckFor == "" {
+			return errors.New("probe ID is empty")
+		}
+	default:
+		return fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	if msg.Signer != msg.Sender {
+		return fmt.Errorf("message from %s is signed by %s", msg.Sender, msg.Signer)
+	}
+	return peer.verifySignature(msg)
+}
+func (peer *Peer) receiveMessage(msg *Message) {
+	peer.logEvent("Received message %s from %s", msg.ID, msg.Sender)
+	if isGroupAddress(msg.Recipients[0]) {
+		peer.receiveGroupMessage(msg)
+		return
+	}
+	if msg.HopCount >= msg.MaxHops {
+		peer.logEvent("Message %s reached max hops. Discarding.", msg.ID)
+		return
+	}
+	isRecipient := false
+	for i, recipient := range msg.Recipients {
+		if recipient == peer.name {
+			isRecipient = true
+			msg.Recipients = append(msg.Recipients[:i], msg.Recipients[i+1:]...)
+			break
+		}
+	}
+	if isRecipient {
+		duplicate := peer.markSeen(msg.ID, time.Now())
+		if duplicate {
+			peer.logEvent("Already received message %s. Acknowledging again.", msg.ID)
+			peer.sendAck(msg)
+		} else if peer.deliver(msg) {
+			peer.sendAck(msg)
+		}
+	}
+	msg.HopCount++
+	peer.holdOffline(msg)
+	if len(msg.Recipients) > 0 {
+		peer.forwardMessage(msg)
+	} else {
+		peer.logEvent("All recipients handled for message %s. Not forwarding.", msg.ID)
+	}
+}
+func (peer *Peer) SendFile(recipients []string, path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > maxFileSize {
+		return "", fmt.Errorf("file is larger than %d bytes", maxFileSize)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return peer.sendFileData(recipients, filepath.Base(path), data)
+}
+func (peer *Peer) sendFileData(recipients []string, name string, data []byte) (string, error) {
+	if len(data) > maxFileSize {
+		return "", fmt.Errorf("file is larger than %d bytes", maxFileSize)
+	}
+	name = filepath.Base(name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	peer.ringMutex.Lock()
+	var unseen, offline []string
+	for _, recipient := range recipients {
+		if isGroupAddress(recipient) {
+			continue
+		}
+		if _, ok := peer.peerKeys[recipient]; !ok {
+			unseen = append(unseen, recipient)
+		} else if _, ok := peer.members[recipient]; !ok {
+			offline = append(offline, recipient)
+		}
+	}
+	peer.ringMutex.Unlock()
+	if len(unseen) > 0 {
+		return "", fmt.Errorf("no public key for %s: they have never been on the ring", strings.Join(unseen, ", "))
+	}
+	if len(offline) > 0 {
+		return "", fmt.Errorf("not on the ring: %s; files are not held for offline peers", strings.Join(offline, ", "))
+	}
+	id := peer.generateMessageID()
+	sum := sha256.Sum256(data)
+	total := chunkCount(int64(len(data)))
+	transfer := &outgoingTransfer{
+		name:       name,
+		total:      total,
+		recipients: append([]string(nil), recipients...),
+		acked:      make(map[string]int),
+		failed:     make(map[string]bool),
+	}
+	peer.transferMutex.Lock()
+	peer.outgoing[id] = transfer
+	peer.transferMutex.Unlock()
+	record := Message{
+		ID:         id,
+		Type:       MessageTypeFileChunk,
+		Sender:     peer.name,
+		Recipients: recipients,
+		Content:    fmt.Sprintf("file %s (%d bytes)", name, len(data)),
+		Timestamp:  time.Now().Unix(),
+	}
+	peer.storeMessage(DirectionSent, &record)
+	peer.logEvent("Sending file %s (%d bytes, %d chunks) to %v as %s", name, len(data), total, recipients, id)
+	for seq := 0; seq < total; seq++ {
+		end := (seq + 1) * fileChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		peer.send(Message{
+			ID:         fmt.Sprintf("%s-%d", id, seq),
+			Type:       MessageTypeFileChunk,
+			Sender:     peer.name,
+			Recipients: append([]string(nil), recipients...),
+			Content:    base64.StdEncoding.EncodeToString(data[seq*fileChunkSize : end]),
+			MaxHops:    peer.options.MaxHops,
+			Timestamp:  time.Now().Unix(),
+			ReplyTo:    peer.name,
+			File: &FileChunk{
+				Transfer: id,
+				Name:     name,
+				Size:     int64(len(data)),
+				Seq:      seq,
+				Total:    total,
+				Checksum: hex.EncodeToString(sum[:]),
+			},
+		}, id)
+	}
+	return id, nil
+}
+func (peer *Peer) chunkSettled(id string, recipient string, status string) {
+	peer.transferMutex.Lock()
+	transfer, ok := peer.outgoing[id]
+	if !ok || transfer.failed[recipient] || isGroupAddress(recipient) {
+		peer.transferMutex.Unlock()
+		return
+	}
+	var progress string
+	if status == DeliveryFailed {
+		transfer.failed[recipient] = true
+		progress = fmt.Sprintf("File %s to %s failed", transfer.name, recipient)
+	} else {
+		transfer.acked[recipient]++
+		acked := transfer.acked[recipient]
+		if acked*10/transfer.total != (acked-1)*10/transfer.total || acked == transfer.total {
+			progress = fmt.Sprintf("File %s to %s: %d%% (%d/%d chunks)", transfer.name, recipient, acked*100/transfer.total, acked, transfer.total)
+		}
+	}
+	finished := true
+	for _, r := range transfer.recipients {
+		if isGroupAddress(r) || !transfer.failed[r] && transfer.acked[r] < transfer.total {
+			finished = false
+		}
+	}
+	if finished {
+		delete(peer.outgoing, id)
+	}
+	peer.transferMutex.Unlock()
+	if progress != "" {
+		peer.logEvent("%s", progress)
+		peer.report(progress)
+	}
+}
+func (peer *Peer) receiveChunk(msg *Message, content string) bool {
+	data, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		peer.logError("Invalid data in file chunk %s: %v", msg.ID, err)
+		return false
+	}
+	file := msg.File
+	if len(data) > fileChunkSize {
+		peer.logError("File chunk %s is larger than %d bytes", msg.ID, fileChunkSize)
+		return false
+	}
+	peer.transferMutex.Lock()
+	transfer, ok := peer.incoming[file.Transfer]
+	if !ok {
+		transfer = &incomingTransfer{
+			name:     filepath.Base(file.Name),
+			sender:   msg.Sender,
+			size:     file.Size,
+			total:    file.Total,
+			checksum: file.Checksum,
+			chunks:   make(map[int][]byte),
+		}
+		peer.incoming[file.Transfer] = transfer
+	}
+	if transfer.sender != msg.Sender || transfer.size != file.Size || transfer.total != file.Total || transfer.checksum != file.Checksum {
+		peer.transferMutex.Unlock()
+		peer.logError("File chunk %s does not match transfer %s", msg.ID, file.Transfer)
+		return false
+	}
+	transfer.received += int64(len(data) - len(transfer.chunks[file.Seq]))
+	if transfer.received > transfer.size {
+		delete(peer.incoming, file.Transfer)
+		peer.transferMutex.Unlock()
+		peer.logError("Transfer %s from %s sent more than %d bytes. Dropping it.", file.Transfer, msg.Sender, transfer.size)
+		return false
+	}
+	transfer.chunks[file.Seq] = data
+	transfer.updated = time.Now()
+	received := len(transfer.chunks)
+	complete := received == transfer.total
+	if complete {
+		delete(peer.incoming, file.Transfer)
+	}
+	peer.transferMutex.Unlock()
+	if received*10/transfer.total != (received-1)*10/transfer.total && !complete {
+		peer.report(fmt.Sprintf("Receiving file %s from %s: %d%% (%d/%d chunks)", transfer.name, transfer.sender, received*100/transfer.total, received, transfer.total))
+	}
+	if complete {
+		peer.completeTransfer(file.Transfer, transfer, msg)
+	}
+	return true
+}
+func (peer *Peer) completeTransfer(id string, transfer *incomingTransfer, msg *Message) {
+	var data []byte
+	for seq := 0; seq < transfer.total; seq++ {
+		data = append(data, transfer.chunks[seq]...)
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != transfer.size || hex.EncodeToString(sum[:]) != transfer.checksum {
+		peer.logError("Checksum mismatch for file %s from %s", transfer.name, transfer.sender)
+		peer.report(fmt.Sprintf("File %s from %s is corrupted and was discarded", transfer.name, transfer.sender))
+		return
+	}
+	path, err := peer.saveDownload(transfer.name, data)
+	if err != nil {
+		peer.logError("Failed to save file %s: %v", transfer.name, err)
+		peer.report(fmt.Sprintf("Failed to save file %s from %s", transfer.name, transfer.sender))
+		return
+	}
+	record := Message{
+		ID:         id,
+		Type:       MessageTypeFileChunk,
+		Sender:     transfer.sender,
+		Recipients: msg.Recipients,
+		Content:    fmt.Sprintf("file %s (%d bytes) saved to %s", transfer.name, len(data), path),
+		Timestamp:  msg.Timestamp,
+	}
+	peer.messageMutex.Lock()
+	peer.receivedMessages = append(peer.receivedMessages, record)
+	peer.messageMutex.Unlock()
+	peer.storeMessage(DirectionReceived, &record)
+	peer.logEvent("Received file %s from %s into %s", transfer.name, transfer.sender, path)
+	peer.report(fmt.Sprintf("Received file %s from %s: saved to %s", transfer.name, transfer.sender, path))
+}
+func chunkCount(size int64) int {
+	if size == 0 {
+		return 1
+	}
+	return int((size + fileChunkSize - 1) / fileChunkSize)
+}
+func (peer *Peer) expireTransfers() {
+	peer.transferMutex.Lock()
+	defer peer.transferMutex.Unlock()
+	for id, transfer := range peer.incoming {
+		if time.Since(transfer.updated) >= transferTimeout {
+			delete(peer.incoming, id)
+			peer.logEvent("Transfer of %s from %s stalled at %d/%d chunks. Dropping it.", transfer.name, transfer.sender, len(transfer.chunks), transfer.total)
+		}
+	}
+}
+func (peer *Peer) saveDownload(name string, data []byte) (string, error) {
+	err := os.MkdirAll(peer.options.DownloadDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	extension := filepath.Ext(name)
+	base := strings.TrimSuffix(name, extension)
+	path := filepath.Join(peer.options.DownloadDir, name)
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if os.IsExist(err) {
+			path = filepath.Join(peer.options.DownloadDir, fmt.Sprintf("%s (%d)%s", base, i, extension))
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = file.Write(data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return path, err
+	}
+}
+func (peer *Peer) report(text string) {
+	peer.consoleMutex.Lock()
+	fmt.Fprintf(peer.output, "\n%s\n", text)
+	fmt.Fprint(peer.output, "Enter command: ")
+	peer.consoleMutex.Unlock()
+	peer.emit(Event{Type: EventFileProgress, Text: text})
+}
+func (peer *Peer) receiveGroupMessage(msg *Message) {
+	if msg.Origin == peer.selfAddr() {
+		peer.logEvent("Message %s to %s went around the ring", msg.ID, msg.Recipients[0])
+		peer.markDelivery(msg.ID, msg.Recipients[0], DeliveryDelivered)
+		return
+	}
+	if msg.HopCount >= msg.MaxHops {
+		peer.logEvent("Message %s reached max hops. Discarding.", msg.ID)
+		return
+	}
+	if peer.markSeen(msg.ID, time.Now()) {
+		peer.logEvent("Already handled message %s. Not forwarding.", msg.ID)
+		return
+	}
+	if peer.subscribed(msg.Recipients[0]) && peer.deliver(msg) {
+		peer.sendAck(msg)
+	}
+	msg.HopCount++
+	peer.forwardMessage(msg)
+}
+func (peer *Peer) deliver(msg *Message) bool {
+	content, err := peer.decryptContent(msg)
+	if err != nil {
+		peer.logError("Failed to decrypt message %s: %v", msg.ID, err)
+		return false
+	}
+	peer.tick(msg.Clock)
+	if msg.Type == MessageTypeFileChunk {
+		return peer.receiveChunk(msg, content)
+	}
+	plain := *msg
+	plain.Content = content
+	plain.Ephemeral = nil
+	plain.Wrapped = nil
+	plain.Signature = nil
+	peer.messageMutex.Lock()
+	peer.receivedMessages = append(peer.receivedMessages, plain)
+	peer.messageMutex.Unlock()
+	peer.storeMessage(DirectionReceived, &plain)
+	peer.logEvent("Message %s is for us. Handling.", msg.ID)
+	from := plain.Sender
+	if len(plain.Recipients) == 1 && isGroupAddress(plain.Recipients[0]) {
+		from = fmt.Sprintf("%s to %s", plain.Sender, plain.Recipients[0])
+	}
+	peer.consoleMutex.Lock()
+	fmt.Fprintf(peer.output, "\nReceived message from %s: %s\n", from, plain.Content)
+	fmt.Fprint(peer.output, "Enter command: ")
+	peer.consoleMutex.Unlock()
+	peer.emit(Event{Type: EventMessageReceived, Message: &plain})
+	return true
+}
+func (peer *Peer) sendAck(msg *Message) {
+	if msg.ReplyTo == "" {
+		return
+	}
+	if msg.ReplyTo == peer.name {
+		peer.markDelivery(msg.ID, peer.name, DeliveryDelivered)
+		return
+	}
+	ack := Message{
+		ID:         peer.generateMessageID(),
+		Type:       MessageTypeAck,
+		Sender:     peer.name,
+		Recipients: []string{msg.ReplyTo},
+		AckFor:     msg.ID,
+		MaxHops:    controlMaxHops,
+		Timestamp:  time.Now().Unix(),
+	}
+	peer.signMessage(&ack)
+	peer.logEvent("Acknowledging message %s to %s", msg.ID, msg.ReplyTo)
+	peer.routeMessage(&ack)
+}
+func (peer *Peer) handleAck(msg *Message) {
+	if msg.HopCount >= msg.MaxHops {
+		peer.logEvent("Acknowledgement %s reached max hops. Discarding.", msg.ID)
+		return
+	}
+	if msg.Recipients[0] == peer.name {
+		peer.logEvent("Message %s delivered to %s", msg.AckFor, msg.Sender)
+		peer.markDelivery(msg.AckFor, msg.Sender, DeliveryDelivered)
+		return
+	}
+	msg.HopCount++
+	peer.forwardMessage(msg)
+}
+func (peer *Peer) holdOffline(msg *Message) {
+	if msg.Type != "" && msg.Type != MessageTypeChat || len(msg.Recipients) == 0 || isGroupAddress(msg.Recipients[0]) {
+		return
+	}
+	var online, offline []string
+	peer.ringMutex.Lock()
+	for _, recipient := range msg.Recipients {
+		if _, ok := peer.members[recipient]; ok {
+			online = append(online, recipient)
+		} else {
+			offline = append(offline, recipient)
+		}
+	}
+	peer.ringMutex.Unlock()
+	for _, recipient := range offline {
+		peer.holdMessage(msg, recipient)
+	}
+	msg.Recipients = online
+}
+func (peer *Peer) holdMessage(msg *Message, recipient string) {
+	held := *msg
+	held.Recipients = []string{recipient}
+	held.Reverse = false
+	peer.mailboxMutex.Lock()
+	for _, other := range peer.mailbox[recipient] {
+		if other.msg.ID == msg.ID {
+			peer.mailboxMutex.Unlock()
+			return
+		}
+	}
+	peer.mailbox[recipient] = append(peer.mailbox[recipient], heldMessage{msg: held, expires: time.Now().Add(peer.options.MailboxTTL)})
+	peer.mailboxMutex.Unlock()
+	peer.logEvent("%s is not on the ring. Holding message %s for %v.", recipient, msg.ID, peer.options.MailboxTTL)
+	peer.notifySender(msg, MessageTypeQueued, recipient)
+}
+func (peer *Peer) flushMailbox(name string) {
+	peer.mailboxMutex.Lock()
+	held := peer.mailbox[name]
+	delete(peer.mailbox, name)
+	peer.mailboxMutex.Unlock()
+	for _, h := range held {
+		msg := h.msg
+		msg.HopCount = 0
+		if len(msg.Ephemeral) == 0 {
+			if err := peer.encryptContent(&msg, msg.Recipients); err != nil {
+				peer.logError("Failed to encrypt held message %s for %s: %v", msg.ID, name, err)
+				peer.markDelivery(msg.ID, name, DeliveryFailed)
+				continue
+			}
+			peer.signMessage(&msg)
+		}
+		peer.logEvent("%s joined the ring. Delivering held message %s.", name, msg.ID)
+		peer.routeMessage(&msg)
+	}
+}
+func (peer *Peer) expireMailbox() {
+	now := time.Now()
+	var expired []heldMessage
+	peer.mailboxMutex.Lock()
+	for recipient, held := range peer.mailbox {
+		var kept []heldMessage
+		for _, h := range held {
+			if now.After(h.expires) {
+				expired = append(expired, h)
+			} else {
+				kept = append(kept, h)
+			}
+		}
+		if len(kept) == 0 {
+			delete(peer.mailbox, recipient)
+		} else {
+			peer.mailbox[recipient] = kept
+		}
+	}
+	peer.mailboxMutex.Unlock()
+	for _, h := range expired {
+		peer.logEvent("Held message %s for %s expired", h.msg.ID, h.msg.Recipients[0])
+		peer.notifySender(&h.msg, MessageTypeExpired, h.msg.Recipients[0])
+	}
+}
+func (peer *Peer) notifySender(msg *Message, kind string, recipient string) {
+	if msg.ReplyTo == "" {
+		return
+	}
+	if msg.ReplyTo == peer.name {
+		peer.mailboxStatus(msg.ID, recipient, kind, peer.name)
+		return
+	}
+	notice := Message{
+		ID:         peer.generateMessageID(),
+		Type:       kind,
+		Sender:     peer.name,
+		Recipients: []string{msg.ReplyTo},
+		AckFor:     msg.ID,
+		Content:    recipient,
+		MaxHops:    controlMaxHops,
+		Timestamp:  time.Now().Unix(),
+	}
+	peer.signMessage(&notice)
+	peer.routeMessage(&notice)
+}
+func (peer *Peer) handleMailboxNotice(msg *Message) {
+	if msg.HopCount >= msg.MaxHops {
+		peer.logEvent("Notice %s reached max hops. Discarding.", msg.ID)
+		return
+	}
+	if msg.Recipients[0] == peer.name {
+		peer.mailboxStatus(msg.AckFor, msg.Content, msg.Type, msg.Sender)
+		return
+	}
+	msg.HopCount++
+	peer.forwardMessage(msg)
+}
+func (peer *Peer) mailboxStatus(id string, recipient string, kind string, holder string) {
+	status := DeliveryQueued
+	text := fmt.Sprintf("%s is offline. Message %s is held by %s until they rejoin.", recipient, id, holder)
+	if kind == MessageTypeExpired {
+		status = DeliveryExpired
+		text = fmt.Sprintf("Message %s to %s expired in the mailbox of %s.", id, recipient, holder)
+	}
+	peer.sentMutex.Lock()
+	sent, ok := peer.sentMessages[id]
+	known := ok && sent.Status[recipient] != DeliveryDelivered && sent.Status[recipient] != status
+	peer.sentMutex.Unlock()
+	if !known {
+		return
+	}
+	peer.markDelivery(id, recipient, status)
+	peer.consoleMutex.Lock()
+	fmt.Fprintf(peer.output, "\n%s\n", text)
+	fmt.Fprint(peer.output, "Enter command: ")
+	peer.consoleMutex.Unlock()
+}
+func (peer *Peer) markDelivery(id string, recipient string, status string) {
+	peer.sentMutex.Lock()
+	sent, ok := peer.sentMessages[id]
+	if !ok || sent.Status[recipient] == status || sent.Status[recipient] == DeliveryDelivered {
+		peer.sentMutex.Unlock()
+		return
+	}
+	sent.Status[recipient] = status
+	transfer := sent.transfer
+	if transfer != "" {
+		settled := true
+		for _, s := range sent.Status {
+			if s == DeliveryPending {
+				settled = false
+			}
+		}
+		if settled {
+			delete(peer.sentMessages, id)
+		}
+	}
+	peer.sentMutex.Unlock()
+	if transfer != "" {
+		peer.chunkSettled(transfer, recipient, status)
+		return
+	}
+	peer.logEvent("Delivery status of message %s to %s: %s", id, recipient, status)
+	peer.emit(Event{Type: EventDeliveryStatus, ID: id, Recipient: recipient, Status: status})
+}
+func (peer *Peer) retransmitPending() {
+	var retries []Message
+	var failed [][2]string
+	peer.sentMutex.Lock()
+	for id, sent := range peer.sentMessages {
+		var pending []string
+		for _, recipient := range sent.Message.Recipients {
+			if sent.Status[recipient] == DeliveryPending {
+				pending = append(pending, recipient)
+			}
+		}
+		if len(pending) == 0 || time.Since(sent.LastSent) < peer.options.AckTimeout {
+			continue
+		}
+		if sent.Attempts >= maxDeliveries {
+			for _, recipient := range pending {
+				failed = append(failed, [2]string{id, recipient})
+			}
+			continue
+		}
+		sent.Attempts++
+		sent.LastSent = time.Now()
+		var resend []string
+		for _, recipient := range pending {
+			if !isGroupAddress(recipient) {
+				resend = append(resend, recipient)
+			}
+		}
+		if len(resend) > 0 {
+			retry := sent.wire
+			retry.Recipients = resend
+			retries = append(retries, retry)
+		}
+	}
+	peer.sentMutex.Unlock()
+	for _, f := range failed {
+		peer.markDelivery(f[0], f[1], DeliveryFailed)
+	}
+	for i := range retries {
+		peer.logEvent("Retransmitting message %s to %v", retries[i].ID, retries[i].Recipients)
+		peer.routeMessage(&retries[i])
+	}
+}
+func (peer *Peer) loadKeys() error {
+	path := peer.path("keys")
+	var stored keyFile
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &stored)
+		if err != nil {
+			return err
+		}
+		if len(stored.Sign) != ed25519.SeedSize {
+			return fmt.Errorf("invalid signing key in %s", path)
+		}
+		peer.signKey = ed25519.NewKeyFromSeed(stored.Sign)
+		peer.boxKey, err = ecdh.X25519().NewPrivateKey(stored.Box)
+		if err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		_, peer.signKey, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		peer.boxKey, err = ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		data, err = json.Marshal(keyFile{Sign: peer.signKey.Seed(), Box: peer.boxKey.Bytes()})
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(path, data, 0600)
+		if err != nil {
+			return err
+		}
+		peer.logEvent("Generated new keypair in %s", path)
+	} else {
+		return err
+	}
+	peer.ringMutex.Lock()
+	peer.peerKeys[peer.name] = peer.ownKeys()
+	peer.ringMutex.Unlock()
+	return nil
+}
+func (peer *Peer) ownKeys() PeerKeys {
+	return PeerKeys{
+		Sign: peer.signKey.Public().(ed25519.PublicKey),
+		Box:  peer.boxKey.PublicKey().Bytes(),
+	}
+}
+func signedPayload(msg *Message) []byte {
+	payload := *msg
+	payload.Recipients = nil
+	payload.HopCount = 0
+	payload.Nodes = nil
+	payload.Reverse = false
+	payload.Signature = nil
+	data, _ := json.Marshal(payload)
+	return data
+}
+func (peer *Peer) signMessage(msg *Message) {
+	msg.Signer = peer.name
+	msg.Signature = ed25519.Sign(peer.signKey, signedPayload(msg))
+}
+func (peer *Peer) verifySignature(msg *Message) error {
+	if msg.Signer == "" || len(msg.Signature) == 0 {
+		return errors.New("message is not signed")
+	}
+	peer.ringMutex.Lock()
+	keys, ok := peer.peerKeys[msg.Signer]
+	peer.ringMutex.Unlock()
+	if !ok {
+		switch msg.Type {
+		case MessageTypeJoin, MessageTypeJoined, MessageTypeWelcome:
+			keys, ok = msg.Keys[msg.Signer]
+		}
+	}
+	if !ok || len(keys.Sign) != ed25519.PublicKeySize {
+		return fmt.Errorf("unknown public key for %s", msg.Signer)
+	}
+	if !ed25519.Verify(keys.Sign, signedPayload(msg), msg.Signature) {
+		return fmt.Errorf("signature does not match %s", msg.Signer)
+	}
+	return nil
+}
+func sealBytes(key []byte, plaintext []byte, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+func openBytes(key []byte, sealed []byte, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+}
+func wrappingKey(shared []byte, ephemeral []byte, recipient []byte) []byte {
+	hash := sha256.New()
+	hash.Write(shared)
+	hash.Write(ephemeral)
+	hash.Write(recipient)
+	return hash.Sum(nil)
+}
+func (peer *Peer) encryptContent(msg *Message, readers []string) error {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	contentKey := make([]byte, 32)
+	if _, err := rand.Read(contentKey); err != nil {
+		return err
+	}
+	sealed, err := sealBytes(contentKey, []byte(msg.Content), []byte(msg.ID))
+	if err != nil {
+		return err
+	}
+	msg.Ephemeral = ephemeral.PublicKey().Bytes()
+	msg.Wrapped = make(map[string]string, len(readers))
+	for _, recipient := range readers {
+		peer.ringMutex.Lock()
+		keys := peer.peerKeys[recipient]
+		peer.ringMutex.Unlock()
+		public, err := ecdh.X25519().NewPublicKey(keys.Box)
+		if err != nil {
+			return fmt.Errorf("invalid public key for %s: %v", recipient, err)
+		}
+		shared, err := ephemeral.ECDH(public)
+		if err != nil {
+			return err
+		}
+		wrapped, err := sealBytes(wrappingKey(shared, msg.Ephemeral, keys.Box), contentKey, []byte(msg.ID))
+		if err != nil {
+			return err
+		}
+		msg.Wrapped[recipient] = base64.StdEncoding.EncodeToString(wrapped)
+	}
+	msg.Content = base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+func (peer *Peer) decryptContent(msg *Message) (string, error) {
+	encoded, ok := msg.Wrapped[peer.name]
+	if !ok {
+		return "", errors.New("message is not encrypted for us")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(msg.Content)
+	if err != nil {
+		return "", err
+	}
+	public, err := ecdh.X25519().NewPublicKey(msg.Ephemeral)
+	if err != nil {
+		return "", err
+	}
+	shared, err := peer.boxKey.ECDH(public)
+	if err != nil {
+		return "", err
+	}
+	contentKey, err := openBytes(wrappingKey(shared, msg.Ephemeral, peer.boxKey.PublicKey().Bytes()), wrapped, []byte(msg.ID))
+	if err != nil {
+		return "", err
+	}
+	content, err := openBytes(contentKey, sealed, []byte(msg.ID))
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+func writeMessage(w io.Writer, msg *Message) error {
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	msgBytes = append(msgBytes, '\n')
+	_, err = w.Write(msgBytes)
+	return err
+}
+func (peer *Peer) dial(addr string) (net.Conn, error) {
+	scheme, hostport, err := splitAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := NewTransport(scheme, peer.options.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	return transport.Dial(hostport, dialTimeout)
+}
+func (peer *Peer) requestPeer(addr string, msg *Message) (*Message, error) {
+	conn, err := peer.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	err = writeMessage(conn, msg)
+	if err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var reply Message
+	err = json.Unmarshal(line, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+func (peer *Peer) routeMessage(msg *Message) {
+	if !routable(msg) {
+		peer.forwardMessage(msg)
+		return
+	}
+	var clockwise, backward []string
+	for _, recipient := range msg.Recipients {
+		if peer.shorterBackward(recipient) {
+			backward = append(backward, recipient)
+		} else {
+			clockwise = append(clockwise, recipient)
+		}
+	}
+	if len(backward) > 0 {
+		reverse := *msg
+		reverse.Recipients = backward
+		reverse.Reverse = true
+		peer.forwardMessage(&reverse)
+	}
+	if len(clockwise) > 0 {
+		msg.Recipients = clockwise
+		msg.Reverse = false
+		peer.forwardMessage(msg)
+	}
+}
+func routable(msg *Message) bool {
+	switch msg.Type {
+	case "", MessageTypeChat, MessageTypeFileChunk, MessageTypeAck, MessageTypeQueued, MessageTypeExpired:
+		return len(msg.Recipients) > 0 && !isGroupAddress(msg.Recipients[0])
+	}
+	return false
+}
+func (peer *Peer) shorterBackward(name string) bool {
+	peer.ringMutex.Lock()
+	defer peer.ringMutex.Unlock()
+	if peer.predecessor == "" {
+		return false
+	}
+	for i, member := range peer.order {
+		if member == name {
+			return len(peer.order)-i < i
+		}
+	}
+	return false
+}
+func (peer *Peer) forwardMessage(msg *Message) {
+	peer.sendMutex.Lock()
+	peer.routeLocked(msg)
+	events := peer.sendEvents
+	peer.sendEvents = nil
+	peer.sendMutex.Unlock()
+	for _, event := range events {
+		peer.emit(event)
+	}
+}
+func (peer *Peer) queueEvent(event Event) {
+	peer.sendEvents = append(peer.sendEvents, event)
+}
+func (peer *Peer) routeLocked(msg *Message) {
+	if msg.Reverse {
+		if peer.forwardBackward(msg) {
+			return
+		}
+		peer.logEvent("Predecessor is unreachable. Sending message %s clockwise.", msg.ID)
+		msg.Reverse = false
+		peer.forwardClockwise(msg)
+		return
+	}
+	if peer.forwardClockwise(msg) || !routable(msg) {
+		return
+	}
+	peer.logEvent("No successor. Sending message %s counter-clockwise.", msg.ID)
+	msg.Reverse = true
+	if !peer.forwardBackward(msg) {
+		peer.logEvent("No predecessor in the ring. Cannot forward message %s", msg.ID)
+	}
+}
+func (peer *Peer) forwardClockwise(msg *Message) bool {
+	for {
+		addr := peer.currentSuccessor()
+		if addr == "" {
+			peer.logEvent("No successor in the ring. Cannot forward message %s", msg.ID)
+			return false
+		}
+		if peer.successorConn == nil || peer.successorAddr != addr {
+			if peer.successorConn != nil {
+				peer.successorConn.Close()
+			}
+			conn, err := peer.dial(addr)
+			if err != nil {
+				peer.logError("Failed to connect to successor %s: %v", addr, err)
+				peer.successorConn = nil
+				peer.queueEvent(Event{Type: EventSuccessorState, Address: addr, State: SuccessorDisconnected})
+				peer.queueEvent(peer.bypassSuccessor(addr))
+				continue
+			}
+			peer.successorConn = conn
+			peer.successorAddr = addr
+			peer.logEvent("Connected to successor %s", addr)
+			peer.queueEvent(Event{Type: EventSuccessorState, Address: addr, State: SuccessorConnected})
+		}
+		err := writeMessage(peer.successorConn, msg)
+		if err != nil {
+			peer.logError("Failed to forward message %s to %s: %v", msg.ID, addr, err)
+			peer.successorConn.Close()
+			peer.successorConn = nil
+			peer.queueEvent(Event{Type: EventSuccessorState, Address: addr, State: SuccessorDisconnected})
+			peer.queueEvent(peer.bypassSuccessor(addr))
+			continue
+		}
+		peer.logEvent("Forwarded message %s to %s", msg.ID, addr)
+		peer.queueForwarded(msg, addr)
+		return true
+	}
+}
+func (peer *Peer) forwardBackward(msg *Message) bool {
+	addr := peer.currentPredecessor()
+	if addr == "" {
+		return false
+	}
+	if peer.predecessorConn == nil || peer.predecessorAddr != addr {
+		if peer.predecessorConn != nil {
+			peer.predecessorConn.Close()
+		}
+		conn, err := peer.dial(addr)
+		if err != nil {
+			peer.logError("Failed to connect to predecessor %s: %v", addr, err)
+			peer.predecessorConn = nil
+			peer.clearPredecessor(addr)
+			return false
+		}
+		peer.predecessorConn = conn
+		peer.predecessorAddr = addr
+		peer.logEvent("Connected to predecessor %s", addr)
+	}
+	err := writeMessage(peer.predecessorConn, msg)
+	if err != nil {
+		peer.logError("Failed to forward message %s to %s: %v", msg.ID, addr, err)
+		peer.predecessorConn.Close()
+		peer.predecessorConn = nil
+		peer.clearPredecessor(addr)
+		return false
+	}
+	peer.logEvent("Forwarded message %s counter-clockwise to %s", msg.ID, addr)
+	peer.queueForwarded(msg, addr)
+	return true
+}
+func (peer *Peer) queueForwarded(msg *Message, addr string) {
+	if msg.Type != MessageTypeChat && msg.Type != MessageTypeFileChunk {
+		return
+	}
+	peer.queueEvent(Event{Type: EventMessageForwarded, ID: msg.ID, Address: addr, Message: &Message{
+		ID:         msg.ID,
+		Type:       msg.Type,
+		Sender:     msg.Sender,
+		Recipients: msg.Recipients,
+		HopCount:   msg.HopCount,
+		MaxHops:    msg.MaxHops,
+		Timestamp:  msg.Timestamp,
+		Reverse:    msg.Reverse,
+	}})
+}
+func (peer *Peer) currentPredecessor() string {
+	peer.ringMutex.Lock()
+	defer peer.ringMutex.Unlock()
+	return peer.predecessor
+}
+func (peer *Peer) setPredecessor(addr string) {
+	if addr == peer.selfAddr() {
+		return
+	}
+	peer.ringMutex.Lock()
+	defer peer.ringMutex.Unlock()
+	if peer.predecessor != addr {
+		peer.predecessor = addr
+		peer.logEvent("Predecessor is now %s", addr)
+	}
+}
+func (peer *Peer) clearPredecessor(addr string) {
+	peer.ringMutex.Lock()
+	defer peer.ringMutex.Unlock()
+	if peer.predecessor == addr {
+		peer.predecessor = ""
+	}
+}
+func (peer *Peer) refreshOrder() {
+	peer.ringMutex.Lock()
+	due := peer.orderStale || time.Since(peer.orderUpdated) >= orderMaxAge
+	peer.orderStale = false
+	peer.ringMutex.Unlock()
+	if !due {
+		return
+	}
+	if peer.Probe().Status == TopologyBroken {
+		peer.ringMutex.Lock()
+		peer.orderStale = true
+		peer.ringMutex.Unlock()
+	}
+}
+func (peer *Peer) applyOrder(topology Topology) {
+	order := make([]string, len(topology.Nodes))
+	for i, node := range topology.Nodes {
+		order[i] = node.Name
+	}
+	if len(topology.Nodes) > 1 {
+		peer.setPredecessor(topology.Nodes[len(topology.Nodes)-1].Address)
+	}
+	peer.ringMutex.Lock()
+	peer.order = order
+	peer.orderUpdated = time.Now()
+	peer.ringMutex.Unlock()
+}
+func (peer *Peer) currentSuccessor() string {
+	peer.ringMutex.Lock()
+	defer peer.ringMutex.Unlock()
+	if len(peer.successors) == 0 {
+		return ""
+	}
+	return peer.successors[0]
+}
+func (peer *Peer) getSuccessors() []string {
+	peer.ringMutex.Lock()
+	defer peer.ringMutex.Unlock()
+	return append([]string(nil), peer.successors...)
+}
+func (peer *Peer) setSuccessors(list []string) {
+	self := peer.selfAddr()
+	var cleaned []string
+	for _, addr := range list {
+		if addr == "" || addr == self {
+			continue
+		}
+		duplicate := false
+		for _, existing := range cleaned {
+			if existing == addr {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			cleaned = append(cleaned, addr)
+		}
+		if len(cleaned) == successorListSize {
+			break
+		}
+	}
+	peer.ringMutex.Lock()
+	peer.successors = cleaned
+	peer.ringMutex.Unlock()
+}
+func (peer *Peer) removeSuccessor(addr string) bool {
+	peer.ringMutex.Lock()
+	defer peer.ringMutex.Unlock()
+	wasFirst := len(peer.successors) > 0 && peer.successors[0] == addr
+	kept := peer.successors[:0]
+	for _, existing := range peer.successors {
+		if existing != addr {
+			kept = append(kept, existing)
+		}
+	}
+	peer.successors = kept
+	return wasFirst
+}
+func (peer *Peer) memberName(addr string) string {
+	peer.ringMutex.Lock()
+	defer peer.ringMutex.Unlock()
+	for name, memberAddr := range peer.members {
+		if memberAddr == addr {
+			return name
+		}
+	}
+	return addr
+}
+func (peer *Peer) bypassSuccessor(addr string) Event {
+	peer.logEvent("Successor %s is unreachable. Bypassing it.", addr)
+	peer.removeSuccessor(addr)
+	name := peer.memberName(addr)
+	peer.ringMutex.Lock()
+	delete(peer.members, name)
+	peer.orderStale = true
+	peer.ringMutex.Unlock()
+	notice := Message{
+		ID:        peer.generateMessageID(),
+		Type:      MessageTypeLeave,
+		Sender:    peer.name,
+		Departed:  name,
+		Address:   addr,
+		Origin:    peer.selfAddr(),
+		MaxHops:   controlMaxHops,
+		Timestamp: time.Now().Unix(),
+	}
+	peer.signMessage(&notice)
+	go peer.forwardMessage(&notice)
+	return Event{Type: EventPeerLeft, Name: name, Address: addr}
+}
+func (peer *Peer) joinRing(bootstrapAddr string) error {
+	join := Message{
+		ID:        peer.generateMessageID(),
+		Type:      MessageTypeJoin,
+		Sender:    peer.name,
+		Address:   peer.selfAddr(),
+		Keys:      map[string]PeerKeys{peer.name: peer.ownKeys()},
+		Timestamp: time.Now().Unix(),
+	}
+	peer.signMessage(&join)
+	reply, err := peer.requestPeer(bootstrapAddr, &join)
+	if err != nil {
+		return err
+	}
+	if reply.Type != MessageTypeWelcome {
+		return fmt.Errorf("unexpected reply %q", reply.Type)
+	}
+	if err := peer.verifySignature(reply); err != nil {
+		return err
+	}
+	peer.setSuccessors(reply.Successors)
+	peer.setPredecessor(reply.Address)
+	peer.ringMutex.Lock()
+	for name, addr := range reply.Members {
+		peer.members[name] = addr
+	}
+	for name, keys := range reply.Keys {
+		if _, ok := peer.peerKeys[name]; !ok {
+			peer.peerKeys[name] = keys
+		}
+	}
+	peer.members[peer.name] = peer.selfAddr()
+	peer.ringMutex.Unlock()
+	peer.logEvent("Joined ring via %s. Successors: %v", bootstrapAddr, peer.getSuccessors())
+	announcement := Message{
+		ID:        peer.generateMessageID(),
+		Type:      MessageTypeJoined,
+		Sender:    peer.name,
+		Address:   peer.selfAddr(),
+		Origin:    peer.selfAddr(),
+		Keys:      map[string]PeerKeys{peer.name: peer.ownKeys()},
+		MaxHops:   controlMaxHops,
+		Timestamp: time.Now().Unix(),
+	}
+	peer.signMessage(&announcement)
+	peer.forwardMessage(&announcement)
+	return nil
+}
+func (peer *Peer) handleJoin(msg *Message) *Message {
+	peer.logEvent("Peer %s (%s) joins the ring after us", msg.Sender, msg.Address)
+	old := peer.getSuccessors()
+	newcomerSuccessors := old
+	if len(newcomerSuccessors) == 0 {
+		newcomerSuccessors = []string{peer.selfAddr()}
+	}
+	peer.setSuccessors(append([]string{msg.Address}, old...))
+	peer.ringMutex.Lock()
+	peer.members[msg.Sender] = msg.Address
+	if _, ok := peer.peerKeys[msg.Sender]; !ok {
+		peer.peerKeys[msg.Sender] = msg.Keys[msg.Sender]
+	}
+	known := make(map[string]string, len(peer.members))
+	for name, addr := range peer.members {
+		known[name] = addr
+	}
+	keys := make(map[string]PeerKeys, len(peer.peerKeys))
+	for name, key := range peer.peerKeys {
+		keys[name] = key
+	}
+	peer.orderStale = true
+	peer.ringMutex.Unlock()
+	peer.emit(Event{Type: EventPeerJoined, Name: msg.Sender, Address: msg.Address})
+	return &Message{
+		ID:         peer.generateMessageID(),
+		Type:       MessageTypeWelcome,
+		Sender:     peer.name,
+		Address:    peer.selfAddr(),
+		Successors: newcomerSuccessors,
+		Members:    known,
+		Keys:       keys,
+	}
+}
+func (peer *Peer) handleJoined(msg *Message) {
+	if msg.Origin == peer.selfAddr() || msg.HopCount >= msg.MaxHops {
+		return
+	}
+	peer.logEvent("Peer %s (%s) joined the ring", msg.Sender, msg.Address)
+	peer.ringMutex.Lock()
+	peer.members[msg.Sender] = msg.Address
+	if _, ok := peer.peerKeys[msg.Sender]; !ok {
+		peer.peerKeys[msg.Sender] = msg.Keys[msg.Sender]
+	}
+	peer.orderStale = true
+	peer.ringMutex.Unlock()
+	peer.emit(Event{Type: EventPeerJoined, Name: msg.Sender, Address: msg.Address})
+	if msg.HopCount == 0 {
+		peer.setPredecessor(msg.Address)
+	}
+	msg.HopCount++
+	peer.forwardMessage(msg)
+	peer.flushMailbox(msg.Sender)
+}
+func (peer *Peer) handleLeave(msg *Message) {
+	if msg.Origin == peer.selfAddr() || msg.Address == peer.selfAddr() || msg.HopCount >= msg.MaxHops {
+		return
+	}
+	if msg.Departed == msg.Sender {
+		peer.logEvent("Peer %s (%s) left the ring", msg.Departed, msg.Address)
+	} else {
+		peer.logEvent("Peer %s (%s) left the ring, reported by %s", msg.Departed, msg.Address, msg.Sender)
+	}
+	peer.ringMutex.Lock()
+	if peer.members[msg.Departed] == msg.Address {
+		delete(peer.members, msg.Departed)
+	}
+	peer.orderStale = true
+	peer.ringMutex.Unlock()
+	peer.emit(Event{Type: EventPeerLeft, Name: msg.Departed, Address: msg.Address})
+	peer.clearPredecessor(msg.Address)
+	wasSuccessor := peer.removeSuccessor(msg.Address)
+	if wasSuccessor {
+		if msg.Departed == msg.Sender {
+			peer.setSuccessors(append(peer.getSuccessors(), msg.Successors...))
+		}
+		if msg.Origin == msg.Address {
+			return
+		}
+	}
+	msg.HopCount++
+	peer.forwardMessage(msg)
+}
+func (peer *Peer) Probe() Topology {
+	id := peer.generateMessageID()
+	result := make(chan Message, 1)
+	peer.probeMutex.Lock()
+	peer.probes[id] = result
+	peer.probeMutex.Unlock()
+	defer func() {
+		peer.probeMutex.Lock()
+		delete(peer.probes, id)
+		peer.probeMutex.Unlock()
+	}()
+	probe := Message{
+		ID:        id,
+		Type:      MessageTypeProbe,
+		Sender:    peer.name,
+		Origin:    peer.selfAddr(),
+		MaxHops:   controlMaxHops,
+		Timestamp: time.Now().Unix(),
+		Nodes:     []NodeInfo{peer.nodeInfo()},
+	}
+	peer.signMessage(&probe)
+	topology := Topology{ID: id, Time: probe.Timestamp, Status: TopologyComplete, Nodes: probe.Nodes}
+	if probe.Nodes[0].Successor != "" {
+		peer.logEvent("Probing the ring with %s", id)
+		peer.forwardMessage(&probe)
+		select {
+		case reply := <-result:
+			topology.Nodes = reply.Nodes
+			if reply.Type == MessageTypeProbeReport {
+				topology.Status = TopologyBroken
+				topology.Problem = reply.Content
+			}
+		case <-time.After(probeTimeout):
+			topology.Status = TopologyBroken
+			topology.Problem = fmt.Sprintf("probe did not return within %v", probeTimeout)
+		case <-peer.done:
+			topology.Status = TopologyBroken
+			topology.Problem = "peer stopped"
+		}
+	}
+	visited := make(map[string]bool, len(topology.Nodes))
+	for _, node := range topology.Nodes {
+		visited[node.Name] = true
+	}
+	peer.ringMutex.Lock()
+	for name := range peer.members {
+		if !visited[name] {
+			topology.Missing = append(topology.Missing, name)
+		}
+	}
+	peer.ringMutex.Unlock()
+	sort.Strings(topology.Missing)
+	if topology.Status == TopologyComplete && len(topology.Missing) > 0 {
+		topology.Status = TopologySplit
+		topology.Problem = fmt.Sprintf("ring does not include %s", strings.Join(topology.Missing, ", "))
+	}
+	peer.logEvent("Probe %s finished: %s", id, topology.Status)
+	if topology.Status != TopologyBroken {
+		peer.applyOrder(topology)
+	}
+	return topology
+}
+func (peer *Peer) nodeInfo() NodeInfo {
+	queue := 0
+	peer.sentMutex.Lock()
+	for _, sent := range peer.sentMessages {
+		for _, status := range sent.Status {
+			if status == DeliveryPending {
+				queue++
+				break
+			}
+		}
+	}
+	peer.sentMutex.Unlock()
+	peer.mailboxMutex.Lock()
+	for _, held := range peer.mailbox {
+		queue += len(held)
+	}
+	peer.mailboxMutex.Unlock()
+	return NodeInfo{
+		Name:      peer.name,
+		Address:   peer.selfAddr(),
+		Uptime:    int64(time.Since(peer.started) / time.Second),
+		Queue:     queue,
+		Successor: peer.currentSuccessor(),
+	}
+}
+func (peer *Peer) handleProbe(msg *Message) {
+	if msg.Origin == peer.selfAddr() {
+		peer.finishProbe(msg)
+		return
+	}
+	for _, node := range msg.Nodes {
+		if node.Address == peer.selfAddr() {
+			peer.reportProbe(msg, fmt.Sprintf("ring loops back to %s without reaching %s", peer.name, msg.Sender))
+			return
+		}
+	}
+	if msg.HopCount >= msg.MaxHops {
+		peer.reportProbe(msg, fmt.Sprintf("probe reached max hops at %s", peer.name))
+		return
+	}
+	info := peer.nodeInfo()
+	msg.Nodes = append(msg.Nodes, info)
+	if info.Successor == "" {
+		peer.reportProbe(msg, fmt.Sprintf("%s has no successor", peer.name))
+		return
+	}
+	msg.HopCount++
+	peer.forwardMessage(msg)
+}
+func (peer *Peer) handleProbeReport(msg *Message) {
+	peer.logEvent("Probe %s stopped at %s: %s", msg.AckFor, msg.Sender, msg.Content)
+	peer.finishProbe(msg)
+}
+func (peer *Peer) finishProbe(msg *Message) {
+	id := msg.ID
+	if msg.Type == MessageTypeProbeReport {
+		id = msg.AckFor
+	}
+	peer.probeMutex.Lock()
+	result, ok := peer.probes[id]
+	peer.probeMutex.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case result <- *msg:
+	default:
+	}
+}
+func (peer *Peer) reportProbe(msg *Message, problem string) {
+	peer.logEvent("Probe %s cannot continue: %s", msg.ID, problem)
+	report := Message{
+		ID:        peer.generateMessageID(),
+		Type:      MessageTypeProbeReport,
+		Sender:    peer.name,
+		AckFor:    msg.ID,
+		Content:   problem,
+		Timestamp: time.Now().Unix(),
+		Nodes:     msg.Nodes,
+	}
+	peer.signMessage(&report)
+	conn, err := peer.dial(msg.Origin)
+	if err != nil {
+		peer.logError("Failed to report probe %s to %s: %v", msg.ID, msg.Origin, err)
+		return
+	}
+	defer conn.Close()
+	err = writeMessage(conn, &report)
+	if err != nil {
+		peer.logError("Failed to report probe %s to %s: %v", msg.ID, msg.Origin, err)
+	}
+}
+func (peer *Peer) leaveRing() {
+	list := peer.getSuccessors()
+	if len(list) == 0 {
+		return
+	}
+	notice := Message{
+		ID:         peer.generateMessageID(),
+		Type:       MessageTypeLeave,
+		Sender:     peer.name,
+		Departed:   peer.name,
+		Address:    peer.selfAddr(),
+		Origin:     peer.selfAddr(),
+		Successors: list,
+		MaxHops:    controlMaxHops,
+		Timestamp:  time.Now().Unix(),
+	}
+	peer.signMessage(&notice)
+	peer.forwardMessage(&notice)
+	peer.logEvent("Left the ring")
+}
+func (peer *Peer) stabilize() {
+	for {
+		addr := peer.currentSuccessor()
+		if addr == "" {
+			return
+		}
+		request := Message{
+			ID:      peer.generateMessageID(),
+			Type:    MessageTypeGetSuccessors,
+			Sender:  peer.name,
+			Address: peer.selfAddr(),
+		}
+		peer.signMessage(&request)
+		reply, err := peer.requestPeer(addr, &request)
+		if err != nil {
+			peer.logError("Successor %s did not answer: %v", addr, err)
+			peer.emit(peer.bypassSuccessor(addr))
+			continue
+		}
+		if err := peer.verifySignature(reply); err != nil {
+			peer.logError("Rejected successor list from %s: %v", addr, err)
+			return
+		}
+		peer.setSuccessors(append([]string{addr}, reply.Successors...))
+		peer.ringMutex.Lock()
+		peer.members[reply.Sender] = addr
+		peer.ringMutex.Unlock()
+		return
+	}
+}
+func (peer *Peer) RunConsole(in io.Reader) bool {
+	reader := bufio.NewReader(in)
+	for {
+		peer.consoleMutex.Lock()
+		fmt.Fprint(peer.output, "Enter command: ")
+		peer.consoleMutex.Unlock()
+		cmdLine, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				peer.logError("Failed to read command: %v", err)
+			}
+			return false
+		}
+		cmdLine = strings.TrimSpace(cmdLine)
+		if cmdLine == "" {
+			continue
+		}
+		parts := strings.Fields(cmdLine)
+		if len(parts) == 0 {
+			continue
+		}
+		switch parts[0] {
+		case "send":
+			if len(parts) < 3 {
+				fmt.Fprintln(peer.output, "Usage: send <recipient1,recipient2,...|#group|*> <message>")
+				continue
+			}
+			recipients := strings.Split(parts[1], ",")
+			content := strings.Join(parts[2:], " ")
+			peer.Send(recipients, content)
+		case "print":
+			peer.printReceivedMessages()
+			peer.printSentMessages()
+		case "ring":
+			peer.printRing()
+		case "topology":
+			peer.printTopology(peer.Probe())
+		case "history":
+			filter, err := parseHistoryFilter(parseHistoryArgs(parts[1:]))
+			if err != nil {
+				fmt.Fprintf(peer.output, "Invalid history filter: %v\n", err)
+				fmt.Fprintln(peer.output, "Usage: history [sender=<name>] [since=<time>] [until=<time>] [page=<n>] [size=<n>]")
+				continue
+			}
+			peer.printHistory(peer.queryHistory(filter))
+		case "sendfile":
+			if len(parts) < 3 {
+				fmt.Fprintln(peer.output, "Usage: sendfile <recipient1,recipient2,...|#group|*> <path>")
+				continue
+			}
+			_, err := peer.SendFile(strings.Split(parts[1], ","), strings.Join(parts[2:], " "))
+			if err != nil {
+				fmt.Fprintf(peer.output, "Failed to send file: %v\n", err)
+			}
+		case "subscribe", "unsubscribe":
+			if len(parts) != 2 {
+				fmt.Fprintf(peer.output, "Usage: %s <group>\n", parts[0])
+				continue
+			}
+			if parts[0] == "subscribe" {
+				err = peer.Subscribe(parts[1])
+			} else {
+				err = peer.Unsubscribe(parts[1])
+			}
+			if err != nil {
+				fmt.Fprintln(peer.output, err)
+			}
+		case "groups":
+			fmt.Fprintf(peer.output, "Subscribed groups: %s\n", strings.Join(peer.Groups(), ", "))
+		case "token":
+			if len(parts) != 2 {
+				fmt.Fprintln(peer.output, "Usage: token <user>")
+				continue
+			}
+			token, err := peer.IssueToken(parts[1])
+			if err != nil {
+				fmt.Fprintf(peer.output, "Failed to issue token: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(peer.output, "API token for %s: %s\n", parts[1], token)
+		case "revoke":
+			if len(parts) != 2 {
+				fmt.Fprintln(peer.output, "Usage: revoke <user>")
+				continue
+			}
+			err := peer.RevokeToken(parts[1])
+			if err != nil {
+				fmt.Fprintln(peer.output, err)
+			}
+		case "leave":
+			peer.Leave()
+			return true
+		default:
+			fmt.Fprintln(peer.output, "Unknown command. Available commands: send, sendfile, print, ring, topology, history, subscribe, unsubscribe, groups, token, revoke, leave")
+		}
+	}
+}
+func (peer *Peer) generateMessageID() string {
+	return fmt.Sprintf("%s-%d", peer.name, time.Now().UnixNano())
+}
+func (peer *Peer) printReceivedMessages() {
+	peer.messageMutex.Lock()
+	defer peer.messageMutex.Unlock()
+	if len(peer.receivedMessages) == 0 {
+		fmt.Fprintln(peer.output, "No messages received.")
+		return
+	}
+	messages := append([]Message(nil), peer.receivedMessages...)
+	sort.SliceStable(messages, func(i, j int) bool {
+		return causalLess(&messages[i], &messages[j])
+	})
+	fmt.Fprintln(peer.output, "Received messages:")
+	for _, msg := range messages {
+		fmt.Fprintf(peer.output, "From: %s; Clock: %d; Content: %s\n", msg.Sender, msg.Clock, msg.Content)
+	}
+}
+func (peer *Peer) tick(received uint64) uint64 {
+	peer.clockMutex.Lock()
+	defer peer.clockMutex.Unlock()
+	if received > peer.clock {
+		peer.clock = received
+	}
+	peer.clock++
+	return peer.clock
+}
+func causalLess(a *Message, b *Message) bool {
+	if a.Clock != b.Clock {
+		return a.Clock < b.Clock
+	}
+	return a.Sender < b.Sender
+}
+func (peer *Peer) printSentMessages() {
+	peer.sentMutex.Lock()
+	defer peer.sentMutex.Unlock()
+	if len(peer.sentOrder) == 0 {
+		fmt.Fprintln(peer.output, "No messages sent.")
+		return
+	}
+	fmt.Fprintln(peer.output, "Sent messages:")
+	for _, id := range peer.sentOrder {
+		sent := peer.sentMessages[id]
+		var statuses []string
+		for _, recipient := range sent.Message.Recipients {
+			statuses = append(statuses, fmt.Sprintf("%s: %s", recipient, sent.Status[recipient]))
+		}
+		var members []string
+		for recipient, status := range sent.Status {
+			if !isGroupAddress(recipient) && len(sent.Message.Recipients) == 1 && isGroupAddress(sent.Message.Recipients[0]) {
+				members = append(members, fmt.Sprintf("%s: %s", recipient, status))
+			}
+		}
+		sort.Strings(members)
+		statuses = append(statuses, members...)
+		fmt.Fprintf(peer.output, "To: %s; Content: %s; Status: %s\n", strings.Join(sent.Message.Recipients, ","), sent.Message.Content, strings.Join(statuses, ", "))
+	}
+}
+func (peer *Peer) openStore() error {
+	path := peer.path("messages")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	loaded := 0
+	for scanner.Scan() {
+		var stored StoredMessage
+		if err := json.Unmarshal(scanner.Bytes(), &stored); err != nil {
+			peer.logError("Skipping corrupt record in %s: %v", path, err)
+			continue
+		}
+		peer.history = append(peer.history, stored)
+		if stored.Message.Clock > peer.clock {
+			peer.clock = stored.Message.Clock
+		}
+		if stored.Direction == DirectionReceived {
+			peer.receivedMessages = append(peer.receivedMessages, stored.Message)
+			peer.markSeen(stored.Message.ID, time.Unix(stored.Stored, 0))
+		}
+		loaded++
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+	peer.storeFile = file
+	peer.logEvent("Loaded %d messages from %s", loaded, path)
+	return nil
+}
+func (peer *Peer) storeMessage(direction string, msg *Message) {
+	stored := StoredMessage{
+		Direction: direction,
+		Stored:    time.Now().Unix(),
+		Message:   *msg,
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		peer.logError("Failed to encode message %s for store: %v", msg.ID, err)
+		return
+	}
+	peer.storeMutex.Lock()
+	defer peer.storeMutex.Unlock()
+	peer.history = append(peer.history, stored)
+	if peer.storeFile == nil {
+		return
+	}
+	if _, err := peer.storeFile.Write(append(data, '\n')); err != nil {
+		peer.logError("Failed to store message %s: %v", msg.ID, err)
+	}
+}
+func (peer *Peer) markSeen(id string, at time.Time) bool {
+	peer.seenMutex.Lock()
+	defer peer.seenMutex.Unlock()
+	if seenAt, ok := peer.seenMessages[id]; ok && time.Since(seenAt) < seenTTL {
+		return true
+	}
+	if time.Since(at) < seenTTL {
+		peer.seenMessages[id] = at
+	}
+	return false
+}
+func (peer *Peer) expireSeen() {
+	peer.seenMutex.Lock()
+	defer peer.seenMutex.Unlock()
+	for id, seenAt := range peer.seenMessages {
+		if time.Since(seenAt) >= seenTTL {
+			delete(peer.seenMessages, id)
+		}
+	}
+}
+func parseHistoryArgs(args []string) map[string]string {
+	result := make(map[string]string)
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			result[""] = arg
+			continue
+		}
+		result[key] = value
+	}
+	return result
+}
+func parseHistoryFilter(args map[string]string) (HistoryFilter, error) {
+	filter := HistoryFilter{Page: 1, Size: historyPageSize}
+	var err error
+	for key, value := range args {
+		switch key {
+		case "sender":
+			filter.Sender = value
+		case "since":
+			filter.Since, err = parseHistoryTime(value)
+		case "until":
+			filter.Until, err = parseHistoryTime(value)
+		case "page":
+			filter.Page, err = strconv.Atoi(value)
+			if err == nil && filter.Page < 1 {
+				err = errors.New("page must be positive")
+			}
+		case "size":
+			filter.Size, err = strconv.Atoi(value)
+			if err == nil && filter.Size < 1 {
+				err = errors.New("size must be positive")
+			}
+		default:
+			err = fmt.Errorf("unknown argument %q", key+value)
+		}
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+func parseHistoryTime(value string) (int64, error) {
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return unix, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %q", value)
+}
+func (peer *Peer) queryHistory(filter HistoryFilter) HistoryPage {
+	peer.storeMutex.Lock()
+	var matched []StoredMessage
+	for _, stored := range peer.history {
+		if filter.Sender != "" && stored.Message.Sender != filter.Sender {
+			continue
+		}
+		if filter.Since != 0 && stored.Message.Timestamp < filter.Since {
+			continue
+		}
+		if filter.Until != 0 && stored.Message.Timestamp > filter.Until {
+			continue
+		}
+		matched = append(matched, stored)
+	}
+	peer.storeMutex.Unlock()
+	sort.SliceStable(matched, func(i, j int) bool {
+		return causalLess(&matched[i].Message, &matched[j].Message)
+	})
+	page := HistoryPage{Total: len(matched), Page: filter.Page, Size: filter.Size, Messages: []StoredMessage{}}
+	start := (filter.Page - 1) * filter.Size
+	if start >= len(matched) {
+		return page
+	}
+	end := start + filter.Size
+	if end > len(matched) {
+		end = len(matched)
+	}
+	page.Messages = matched[start:end]
+	return page
+}
+func (peer *Peer) printHistory(page HistoryPage) {
+	if page.Total == 0 {
+		fmt.Fprintln(peer.output, "No messages in history.")
+		return
+	}
+	pages := (page.Total + page.Size - 1) / page.Size
+	fmt.Fprintf(peer.output, "History page %d of %d (%d messages):\n", page.Page, pages, page.Total)
+	for _, stored := range page.Messages {
+		msg := stored.Message
+		when := time.Unix(msg.Timestamp, 0).Format("2006-01-02 15:04:05")
+		if stored.Direction == DirectionSent {
+			fmt.Fprintf(peer.output, "[%s #%d] Sent to %s: %s\n", when, msg.Clock, strings.Join(msg.Recipients, ","), msg.Content)
+		} else {
+			fmt.Fprintf(peer.output, "[%s #%d] From %s: %s\n", when, msg.Clock, msg.Sender, msg.Content)
+		}
+	}
+}
+func (peer *Peer) printTopology(topology Topology) {
+	fmt.Fprintf(peer.output, "Ring topology (%s):\n", topology.Status)
+	for i, node := range topology.Nodes {
+		fmt.Fprintf(peer.output, "%d. %s (%s) uptime %v, queue %d\n", i+1, node.Name, node.Address, time.Duration(node.Uptime)*time.Second, node.Queue)
+	}
+	if topology.Problem != "" {
+		fmt.Fprintf(peer.output, "Problem: %s\n", topology.Problem)
+	}
+}
+func (peer *Peer) printRing() {
+	peer.ringMutex.Lock()
+	defer peer.ringMutex.Unlock()
+	fmt.Fprintf(peer.output, "Successors: %v\n", peer.successors)
+	fmt.Fprintf(peer.output, "Predecessor: %s\n", peer.predecessor)
+	if len(peer.order) > 0 {
+		fmt.Fprintf(peer.output, "Ring order: %s\n", strings.Join(peer.order, " -> "))
+	}
+	fmt.Fprintln(peer.output, "Known peers:")
+	for name, addr := range peer.members {
+		fmt.Fprintf(peer.output, "%s: %s\n", name, addr)
+	}
+}
+func (peer *Peer) logEvent(format string, v ...interface{}) {
+	peer.logger.Printf("EVENT: "+format, v...)
+}
+func (peer *Peer) logError(format string, v ...interface{}) {
+	peer.logger.Printf("ERROR: "+format, v...)
+}
+func (peer *Peer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", peer.serveHome)
+	mux.HandleFunc("/login", peer.handleLogin)
+	mux.HandleFunc("/logout", peer.requireAuth(peer.handleLogout))
+	mux.HandleFunc("/ws", peer.requireAuth(peer.handleWebSocket))
+	mux.HandleFunc("/send", peer.requireAuth(peer.handleSendMessage))
+	mux.HandleFunc("/status", peer.requireAuth(peer.handleStatus))
+	mux.HandleFunc("/history", peer.requireAuth(peer.handleHistory))
+	mux.HandleFunc("/upload", peer.requireAuth(peer.handleUpload))
+	mux.HandleFunc("/api/session", peer.requireAuth(peer.handleSession))
+	mux.HandleFunc("/api/messages", peer.requireAuth(peer.handleAPIMessages))
+	mux.HandleFunc("/api/peers", peer.requireAuth(peer.handleAPIPeers))
+	mux.HandleFunc("/api/topology", peer.requireAuth(peer.handleAPITopology))
+	return mux
+}
+func (peer *Peer) startHTTPServer() {
+	peer.httpServer = &http.Server{Addr: peer.options.HTTPAddress, Handler: peer.Handler()}
+	peer.wg.Add(1)
+	go func() {
+		defer peer.wg.Done()
+		peer.logEvent("Starting HTTP server on %s", peer.options.HTTPAddress)
+		err := peer.httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			peer.logError("HTTP server error: %v", err)
+		}
+	}()
+}
+func (peer *Peer) serveHome(w http.ResponseWriter, r *http.Request) {
+	page := "index.html"
+	if _, err := peer.authenticate(r); err != nil {
+		page = "login.html"
+	}
+	tmpl, err := template.ParseFiles(page)
+	if err != nil {
+		peer.logError("Failed to parse %s: %v", page, err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	err = tmpl.Execute(w, nil)
+	if err != nil {
+		peer.logError("Failed to execute template: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+func (peer *Peer) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := peer.authenticate(r)
+		if err == errBadCSRF {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	}
+}
+func (peer *Peer) authenticate(r *http.Request) (string, error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if user := peer.tokenUser(token); token != auth && user != "" {
+			return user, nil
+		}
+		return "", errNotLoggedIn
+	}
+	current := peer.session(r)
+	if current == nil {
+		return "", errNotLoggedIn
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(current.csrf)) != 1 {
+			return "", errBadCSRF
+		}
+	}
+	return peer.name, nil
+}
+func (peer *Peer) session(r *http.Request) *session {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	peer.authMutex.Lock()
+	defer peer.authMutex.Unlock()
+	current, ok := peer.sessions[cookie.Value]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(current.expires) {
+		delete(peer.sessions, cookie.Value)
+		return nil
+	}
+	return current
+}
+func (peer *Peer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("name")
+	password := r.FormValue("password")
+	if name != peer.name || peer.password == "" || subtle.ConstantTimeCompare([]byte(password), []byte(peer.password)) != 1 {
+		peer.logEvent("Failed web login as %q from %s", name, r.RemoteAddr)
+		http.Redirect(w, r, "/?error=1", http.StatusSeeOther)
+		return
+	}
+	id := randomToken()
+	expires := time.Now().Add(sessionTTL)
+	peer.authMutex.Lock()
+	for key, other := range peer.sessions {
+		if time.Now().After(other.expires) {
+			delete(peer.sessions, key)
+		}
+	}
+	peer.sessions[id] = &session{csrf: randomToken(), expires: expires}
+	peer.authMutex.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	peer.logEvent("Web login as %s from %s", name, r.RemoteAddr)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+func (peer *Peer) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		peer.authMutex.Lock()
+		delete(peer.sessions, cookie.Value)
+		peer.authMutex.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+func (peer *Peer) handleSession(w http.ResponseWriter, r *http.Request) {
+	info := SessionInfo{Name: peer.name}
+	info.User, _ = r.Context().Value(userKey{}).(string)
+	if current := peer.session(r); current != nil {
+		info.CSRF = current.csrf
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+func (peer *Peer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && u.Host == r.Host {
+		return true
+	}
+	for _, allowed := range peer.options.AllowedOrigins {
+		if strings.TrimSuffix(allowed, "/") == origin {
+			return true
+		}
+	}
+	peer.logEvent("Rejected WebSocket connection from origin %s", origin)
+	return false
+}
+func (peer *Peer) IssueToken(user string) (string, error) {
+	if user == "" || strings.ContainsAny(user, " \t") {
+		return "", fmt.Errorf("invalid user name %q", user)
+	}
+	token := randomToken()
+	peer.authMutex.Lock()
+	defer peer.authMutex.Unlock()
+	peer.tokens[user] = hashToken(token)
+	if err := peer.saveTokens(); err != nil {
+		return "", err
+	}
+	peer.logEvent("Issued API token for %s", user)
+	return token, nil
+}
+func (peer *Peer) RevokeToken(user string) error {
+	peer.authMutex.Lock()
+	defer peer.authMutex.Unlock()
+	if _, ok := peer.tokens[user]; !ok {
+		return fmt.Errorf("no API token for %s", user)
+	}
+	delete(peer.tokens, user)
+	peer.logEvent("Revoked API token of %s", user)
+	return peer.saveTokens()
+}
+func (peer *Peer) tokenUser(token string) string {
+	hash := []byte(hashToken(token))
+	peer.authMutex.Lock()
+	defer peer.authMutex.Unlock()
+	for user, stored := range peer.tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(stored)) == 1 {
+			return user
+		}
+	}
+	return ""
+}
+func (peer *Peer) loadTokens() error {
+	data, err := os.ReadFile(peer.path("tokens"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &peer.tokens)
+}
+func (peer *Peer) saveTokens() error {
+	data, err := json.Marshal(peer.tokens)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(peer.path("tokens"), data, 0600)
+}
+func randomToken() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+func (peer *Peer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := peer.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		peer.logError("WebSocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+	queue := make(chan []byte, eventQueueSize)
+	peer.clientsMutex.Lock()
+	peer.clients[conn] = queue
+	peer.clientsMutex.Unlock()
+	peer.logEvent("WebSocket client connected: %s", conn.RemoteAddr().String())
+	go peer.writeEvents(conn, queue)
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			peer.dropClient(conn)
+			peer.logEvent("WebSocket client disconnected: %s", conn.RemoteAddr().String())
+			break
+		}
+	}
+}
+func (peer *Peer) writeEvents(conn *websocket.Conn, queue chan []byte) {
+	for data := range queue {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		err := conn.WriteMessage(websocket.TextMessage, data)
+		if err != nil {
+			peer.logError("WebSocket send error: %v", err)
+			conn.Close()
+			return
+		}
+	}
+}
+func (peer *Peer) dropClient(conn *websocket.Conn) {
+	peer.clientsMutex.Lock()
+	defer peer.clientsMutex.Unlock()
+	if queue, ok := peer.clients[conn]; ok {
+		close(queue)
+		delete(peer.clients, conn)
+	}
+}
+func (peer *Peer) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	peer.handleSendMessagePost(w, r)
+}
+func (peer *Peer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peer.Sent())
+}
+func historyFilterFromQuery(query url.Values) (HistoryFilter, error) {
+	args := make(map[string]string)
+	for _, key := range []string{"sender", "since", "until", "page", "size"} {
+		if value := query.Get(key); value != "" {
+			args[key] = value
+		}
+	}
+	return parseHistoryFilter(args)
+}
+func (peer *Peer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	filter, err := historyFilterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peer.queryHistory(filter))
+}
+func (peer *Peer) handleAPIMessages(w http.ResponseWriter, r *http.Request) {
+	filter, err := historyFilterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	history := peer.queryHistory(filter)
+	if r.URL.Query().Get("page") == "" && history.Total > filter.Size {
+		filter.Page = (history.Total + filter.Size - 1) / filter.Size
+		history = peer.queryHistory(filter)
+	}
+	page := ChatPage{Total: history.Total, Page: history.Page, Size: history.Size, Messages: []ChatEntry{}}
+	peer.sentMutex.Lock()
+	for _, stored := range history.Messages {
+		entry := ChatEntry{Direction: stored.Direction, Message: stored.Message}
+		if sent, ok := peer.sentMessages[stored.Message.ID]; ok && stored.Direction == DirectionSent {
+			entry.Status = make(map[string]string, len(sent.Status))
+			for recipient, status := range sent.Status {
+				entry.Status[recipient] = status
+			}
+		}
+		page.Messages = append(page.Messages, entry)
+	}
+	peer.sentMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+func (peer *Peer) handleAPIPeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peer.ringStatus())
+}
+func (peer *Peer) handleAPITopology(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peer.Probe())
+}
+func (peer *Peer) ringStatus() RingStatus {
+	successors := peer.getSuccessors()
+	status := RingStatus{
+		Name:       peer.name,
+		Address:    peer.selfAddr(),
+		Successors: successors,
+		Members:    []RingMember{},
+		Groups:     peer.Groups(),
+	}
+	peer.sendMutex.Lock()
+	status.SuccessorConnected = peer.successorConn != nil && len(successors) > 0 && peer.successorAddr == successors[0]
+	peer.sendMutex.Unlock()
+	peer.ringMutex.Lock()
+	status.Predecessor = peer.predecessor
+	status.Order = append([]string{}, peer.order...)
+	for name, addr := range peer.members {
+		member := RingMember{Name: name, Address: addr, Self: name == peer.name}
+		for _, successor := range successors {
+			if successor == addr {
+				member.Successor = true
+			}
+		}
+		status.Members = append(status.Members, member)
+	}
+	peer.ringMutex.Unlock()
+	sort.Slice(status.Members, func(i, j int) bool {
+		return status.Members[i].Name < status.Members[j].Name
+	})
+	return status
+}
+func (peer *Peer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize+1024*1024)
+	recipient := r.FormValue("recipient")
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if !peer.knownPeer(recipient) {
+		http.Error(w, "Invalid recipient name", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return
+	}
+	id, err := peer.sendFileData([]string{recipient}, header.Filename, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]string{"status": "success", "id": id}
+	json.NewEncoder(w).Encode(resp)
+}
+func (peer *Peer) handleSendMessagePost(w http.ResponseWriter, r *http.Request) {
+	var req SendMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		peer.logError("Failed to decode send message request: %v", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if req.Sender == "" {
+		req.Sender = peer.name
+	}
+	if req.Recipient == "" || req.Message == "" {
+		http.Error(w, "Missing recipient or message", http.StatusBadRequest)
+		return
+	}
+	if req.Sender != peer.name {
+		http.Error(w, "Sender must be the local peer", http.StatusForbidden)
+		return
+	}
+	if !peer.knownPeer(req.Recipient) {
+		http.Error(w, "Invalid recipient name", http.StatusBadRequest)
+		return
+	}
+	user, _ := r.Context().Value(userKey{}).(string)
+	peer.logEvent("Web user %s sends a message to %s", user, req.Recipient)
+	id := peer.sendMessageFrom(req.Sender, []string{req.Recipient}, req.Message)
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]string{"status": "success", "id": id}
+	json.NewEncoder(w).Encode(resp)
+}
+func (peer *Peer) knownPeer(name string) bool {
+	if isGroupAddress(name) {
+		return true
+	}
+	for _, info := range peer.peers {
+		if info.Name == name {
+			return true
+		}
+	}
+	peer.ringMutex.Lock()
+	defer peer.ringMutex.Unlock()
+	_, ok := peer.members[name]
+	return ok
+}
+func (peer *Peer) sendMessageFrom(sender string, recipients []string, content string) string {
+	return peer.send(Message{
+		ID:         peer.generateMessageID(),
+		Sender:     sender,
+		Recipients: recipients,
+		Content:    content,
+		HopCount:   0,
+		MaxHops:    peer.options.MaxHops,
+		Timestamp:  time.Now().Unix(),
+		ReplyTo:    peer.name,
+	}, "")
+}
+func (peer *Peer) send(msg Message, transfer string) string {
+	msg.Clock = peer.tick(0)
+	recipients := msg.Recipients
+	sent := &SentMessage{
+		Message:  msg,
+		Status:   make(map[string]string),
+		Attempts: 1,
+		LastSent: time.Now(),
+		transfer: transfer,
+	}
+	sent.Message.Recipients = append([]string(nil), recipients...)
+	var unknown []string
+	var unseen []string
+	var readers []string
+	plain := msg
+	msg.Recipients = nil
+	peer.ringMutex.Lock()
+	if len(recipients) == 1 && isGroupAddress(recipients[0]) {
+		sent.Status[recipients[0]] = DeliveryPending
+		msg.Recipients = []string{recipients[0]}
+		msg.Origin = peer.selfAddr()
+		msg.MaxHops = controlMaxHops
+		for name := range peer.peerKeys {
+			if name != peer.name {
+				readers = append(readers, name)
+			}
+		}
+	} else {
+		for _, recipient := range recipients {
+			if _, ok := peer.peerKeys[recipient]; ok {
+				sent.Status[recipient] = DeliveryPending
+				msg.Recipients = append(msg.Recipients, recipient)
+			} else if transfer == "" {
+				sent.Status[recipient] = DeliveryPending
+				unseen = append(unseen, recipient)
+			} else {
+				unknown = append(unknown, recipient)
+			}
+		}
+		readers = msg.Recipients
+	}
+	peer.ringMutex.Unlock()
+	if len(readers) == 0 {
+		msg.Recipients = nil
+	} else if err := peer.encryptContent(&msg, readers); err != nil {
+		peer.logError("Failed to encrypt message %s: %v", msg.ID, err)
+		unknown = recipients
+		msg.Recipients = nil
+	}
+	peer.signMessage(&msg)
+	sent.wire = msg
+	sent.wire.Recipients = append([]string(nil), msg.Recipients...)
+	for _, recipient := range unknown {
+		sent.Status[recipient] = DeliveryFailed
+	}
+	peer.sentMutex.Lock()
+	peer.sentMessages[msg.ID] = sent
+	if transfer == "" {
+		peer.sentOrder = append(peer.sentOrder, msg.ID)
+	}
+	peer.sentMutex.Unlock()
+	if transfer == "" {
+		peer.storeMessage(DirectionSent, &sent.Message)
+		peer.emit(Event{Type: EventMessageSent, Message: &sent.Message})
+	} else {
+		for _, recipient := range unknown {
+			peer.chunkSettled(transfer, recipient, DeliveryFailed)
+		}
+	}
+	if len(unknown) > 0 {
+		peer.logError("No public key for %v. Message %s cannot be delivered to them.", unknown, msg.ID)
+	}
+	if len(unseen) > 0 {
+		peer.logEvent("No public key for %v yet. Message %s will be encrypted when they join.", unseen, msg.ID)
+	}
+	for _, recipient := range unseen {
+		peer.holdMessage(&plain, recipient)
+	}
+	peer.holdOffline(&msg)
+	if len(msg.Recipients) == 0 {
+		return msg.ID
+	}
+	if msg.Origin != "" {
+		peer.markSeen(msg.ID, time.Now())
+	}
+	peer.logEvent("Sending message %s from %s to %v", msg.ID, msg.Sender, msg.Recipients)
+	peer.routeMessage(&msg)
+	return msg.ID
+}
+func (peer *Peer) emit(event Event) {
+	event.Time = time.Now().Unix()
+	event.Peer = peer.name
+	data, err := json.Marshal(event)
+	if err != nil {
+		peer.logError("Failed to encode event %s: %v", event.Type, err)
+		return
+	}
+	peer.clientsMutex.Lock()
+	defer peer.clientsMutex.Unlock()
+	for client, queue := range peer.clients {
+		select {
+		case queue <- data:
+		default:
+			peer.logError("WebSocket client %s is too slow. Disconnecting it.", client.RemoteAddr().String())
+			close(queue)
+			delete(peer.clients, client)
+			client.Close()
+		}
+	}
+}
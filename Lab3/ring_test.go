@@ -0,0 +1,841 @@
+package ring
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func startRing(t *testing.T, size int, configure func(*Options)) []*Peer {
+	t.Helper()
+	dir := t.TempDir()
+	var peers []*Peer
+	for i := 1; i <= size; i++ {
+		options := Options{
+			Name:    fmt.Sprintf("P%d", i),
+			Address: "127.0.0.1:0",
+			Dir:     dir,
+		}
+		if len(peers) > 0 {
+			options.Bootstrap = []string{peers[len(peers)-1].Addr()}
+		}
+		if configure != nil {
+			configure(&options)
+		}
+		peer, err := NewPeer(options)
+		if err != nil {
+			t.Fatalf("new peer: %v", err)
+		}
+		if err := peer.Start(); err != nil {
+			t.Fatalf("start %s: %v", options.Name, err)
+		}
+		t.Cleanup(peer.Stop)
+		peers = append(peers, peer)
+	}
+	waitFor(t, "ring to form", func() bool {
+		for _, peer := range peers {
+			peer.ringMutex.Lock()
+			known := len(peer.peerKeys)
+			peer.ringMutex.Unlock()
+			if known != size {
+				return false
+			}
+		}
+		return true
+	})
+	return peers
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func received(peer *Peer, content string) int {
+	count := 0
+	for _, msg := range peer.Received() {
+		if msg.Content == content {
+			count++
+		}
+	}
+	return count
+}
+
+func deliveryStatus(peer *Peer, id string, recipient string) string {
+	for _, sent := range peer.Sent() {
+		if sent.Message.ID == id {
+			return sent.Status[recipient]
+		}
+	}
+	return ""
+}
+
+func TestForwarding(t *testing.T) {
+	peers := startRing(t, 4, nil)
+	id := peers[0].Send([]string{"P3", "P4"}, "hello ring")
+	waitFor(t, "delivery to P3 and P4", func() bool {
+		return deliveryStatus(peers[0], id, "P3") == DeliveryDelivered && deliveryStatus(peers[0], id, "P4") == DeliveryDelivered
+	})
+	for _, peer := range peers[2:] {
+		messages := peer.Received()
+		if len(messages) != 1 || messages[0].Sender != "P1" || messages[0].Content != "hello ring" {
+			t.Errorf("%s received %+v", peer.Name(), messages)
+		}
+	}
+	if n := len(peers[1].Received()); n != 0 {
+		t.Errorf("P2 is not a recipient but received %d messages", n)
+	}
+}
+
+func TestUnknownRecipient(t *testing.T) {
+	peers := startRing(t, 2, nil)
+	id := peers[0].Send([]string{"P9"}, "nobody home")
+	if status := deliveryStatus(peers[0], id, "P9"); status != DeliveryQueued {
+		t.Errorf("status = %q, want %q", status, DeliveryQueued)
+	}
+	if _, err := peers[0].sendFileData([]string{"P9"}, "notes.txt", []byte("hello")); err == nil {
+		t.Error("file transfer to a peer without a public key was accepted")
+	}
+	newcomer, err := NewPeer(Options{
+		Name:      "P9",
+		Address:   "127.0.0.1:0",
+		Bootstrap: []string{peers[1].Addr()},
+		Dir:       t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newcomer.Start(); err != nil {
+		t.Fatalf("start P9: %v", err)
+	}
+	t.Cleanup(newcomer.Stop)
+	waitFor(t, "held message to be delivered", func() bool {
+		return deliveryStatus(peers[0], id, "P9") == DeliveryDelivered
+	})
+	if n := received(newcomer, "nobody home"); n != 1 {
+		t.Errorf("P9 received the held message %d times, want 1", n)
+	}
+}
+
+func TestMaxHops(t *testing.T) {
+	peers := startRing(t, 6, func(options *Options) {
+		options.MaxHops = 2
+	})
+	far := peers[0].Send([]string{"P4"}, "too far")
+	near := peers[0].Send([]string{"P3"}, "close enough")
+	waitFor(t, "delivery to P3", func() bool {
+		return deliveryStatus(peers[0], near, "P3") == DeliveryDelivered
+	})
+	time.Sleep(100 * time.Millisecond)
+	if n := received(peers[3], "too far"); n != 0 {
+		t.Errorf("P4 received a message beyond max hops %d times", n)
+	}
+	if status := deliveryStatus(peers[0], far, "P4"); status != DeliveryPending {
+		t.Errorf("status = %q, want %q", status, DeliveryPending)
+	}
+}
+
+func TestDuplicateDiscarding(t *testing.T) {
+	peers := startRing(t, 3, func(options *Options) {
+		options.AckTimeout = time.Minute
+	})
+	id := peers[0].Send([]string{"P3"}, "only once")
+	waitFor(t, "delivery to P3", func() bool {
+		return deliveryStatus(peers[0], id, "P3") == DeliveryDelivered
+	})
+	peers[0].sentMutex.Lock()
+	wire := peers[0].sentMessages[id].wire
+	peers[0].sentMutex.Unlock()
+	for i := 0; i < 3; i++ {
+		duplicate := wire
+		duplicate.Recipients = []string{"P3"}
+		peers[0].forwardMessage(&duplicate)
+	}
+	marker := peers[0].Send([]string{"P3"}, "marker")
+	waitFor(t, "marker delivery", func() bool {
+		return deliveryStatus(peers[0], marker, "P3") == DeliveryDelivered
+	})
+	if n := received(peers[2], "only once"); n != 1 {
+		t.Errorf("P3 handled the message %d times, want 1", n)
+	}
+}
+
+func TestForgedSender(t *testing.T) {
+	peers := startRing(t, 3, nil)
+	id := peers[0].Send([]string{"P3"}, "genuine")
+	waitFor(t, "delivery to P3", func() bool {
+		return deliveryStatus(peers[0], id, "P3") == DeliveryDelivered
+	})
+	peers[0].sentMutex.Lock()
+	forged := peers[0].sentMessages[id].wire
+	peers[0].sentMutex.Unlock()
+	forged.ID = "P2-forged"
+	forged.Sender = "P2"
+	forged.Recipients = []string{"P3"}
+	if err := peers[2].validateMessage(&forged); err == nil {
+		t.Fatal("forged message passed validation")
+	}
+	forged.Signer = "P2"
+	if err := peers[2].validateMessage(&forged); err == nil {
+		t.Fatal("message with a foreign signature passed validation")
+	}
+}
+
+func TestForgedLeave(t *testing.T) {
+	peers := startRing(t, 3, nil)
+	forged := Message{
+		ID:         "P1-forged-leave",
+		Type:       MessageTypeLeave,
+		Sender:     "P2",
+		Departed:   "P2",
+		Address:    peers[1].Addr(),
+		Origin:     peers[1].Addr(),
+		Successors: []string{peers[0].Addr()},
+		MaxHops:    controlMaxHops,
+		Timestamp:  time.Now().Unix(),
+	}
+	peers[0].signMessage(&forged)
+	if err := peers[2].validateMessage(&forged); err == nil {
+		t.Fatal("leave signed by P1 on behalf of P2 passed validation")
+	}
+	report := forged
+	report.Sender = "P1"
+	peers[0].signMessage(&report)
+	if err := peers[2].validateMessage(&report); err != nil {
+		t.Fatalf("failure report from P1: %v", err)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	peers := startRing(t, 4, nil)
+	id := peers[0].Send([]string{BroadcastAddress}, "hello everyone")
+	waitFor(t, "broadcast to go around the ring", func() bool {
+		return deliveryStatus(peers[0], id, BroadcastAddress) == DeliveryDelivered
+	})
+	waitFor(t, "acknowledgements from every peer", func() bool {
+		for _, peer := range peers[1:] {
+			if deliveryStatus(peers[0], id, peer.Name()) != DeliveryDelivered {
+				return false
+			}
+		}
+		return true
+	})
+	time.Sleep(100 * time.Millisecond)
+	for _, peer := range peers[1:] {
+		if n := received(peer, "hello everyone"); n != 1 {
+			t.Errorf("%s received the broadcast %d times, want 1", peer.Name(), n)
+		}
+	}
+	if n := received(peers[0], "hello everyone"); n != 0 {
+		t.Errorf("sender received its own broadcast %d times", n)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	peers := startRing(t, 4, nil)
+	for _, peer := range []*Peer{peers[1], peers[3]} {
+		if err := peer.Subscribe("team"); err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+	}
+	id := peers[0].Send([]string{"#team"}, "team only")
+	waitFor(t, "group message to go around the ring", func() bool {
+		return deliveryStatus(peers[0], id, "#team") == DeliveryDelivered
+	})
+	for i, want := range []int{0, 1, 0, 1} {
+		if n := received(peers[i], "team only"); n != want {
+			t.Errorf("%s received the group message %d times, want %d", peers[i].Name(), n, want)
+		}
+	}
+	if err := peers[0].Subscribe("bad,name"); err == nil {
+		t.Error("subscribed to an invalid group name")
+	}
+}
+
+func TestFileTransfer(t *testing.T) {
+	peers := startRing(t, 3, nil)
+	data := make([]byte, 3*fileChunkSize+100)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "report.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peers[0].SendFile([]string{"P3"}, path); err != nil {
+		t.Fatalf("send file: %v", err)
+	}
+	saved := filepath.Join(peers[2].options.DownloadDir, "report.bin")
+	waitFor(t, "file to be saved", func() bool {
+		_, err := os.Stat(saved)
+		return err == nil && received(peers[2], fmt.Sprintf("file report.bin (%d bytes) saved to %s", len(data), saved)) == 1
+	})
+	got, err := os.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("saved file differs from the original")
+	}
+	waitFor(t, "all chunks to be acknowledged", func() bool {
+		peers[0].transferMutex.Lock()
+		defer peers[0].transferMutex.Unlock()
+		return len(peers[0].outgoing) == 0
+	})
+	if n := len(peers[1].Received()); n != 0 {
+		t.Errorf("intermediate peer received %d messages", n)
+	}
+}
+
+func getJSON(t *testing.T, url string, token string, v interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+}
+
+func TestFileNames(t *testing.T) {
+	peers := startRing(t, 3, nil)
+	if _, err := peers[0].sendFileData([]string{"P3"}, "../notes.txt", []byte("hello")); err != nil {
+		t.Fatalf("send file: %v", err)
+	}
+	saved := filepath.Join(peers[2].options.DownloadDir, "notes.txt")
+	waitFor(t, "file to be saved under its base name", func() bool {
+		_, err := os.Stat(saved)
+		return err == nil
+	})
+	chunk := Message{
+		ID:         "P1-chunk",
+		Type:       MessageTypeFileChunk,
+		Sender:     "P1",
+		Recipients: []string{"P3"},
+		Content:    "c2VjcmV0",
+		MaxHops:    defaultMaxHops,
+		Ephemeral:  []byte{1},
+		Wrapped:    map[string]string{"P3": "key"},
+		File:       &FileChunk{Transfer: "P1-transfer", Size: 6, Total: 1},
+	}
+	for name, valid := range map[string]bool{"notes.txt": true, "../../escaped.txt": false, "..": false, ".": false, `..\escaped.txt`: false, "dir/escaped.txt": false} {
+		chunk.File.Name = name
+		peers[0].signMessage(&chunk)
+		if err := peers[2].validateMessage(&chunk); (err == nil) != valid {
+			t.Errorf("file chunk named %q: validation error %v", name, err)
+		}
+	}
+	peers[2].transferMutex.Lock()
+	peers[2].incoming["stale"] = &incomingTransfer{name: "stale.bin", sender: "P1", total: 2, chunks: map[int][]byte{0: {1}}, updated: time.Now().Add(-transferTimeout)}
+	peers[2].incoming["active"] = &incomingTransfer{name: "active.bin", sender: "P1", total: 2, chunks: map[int][]byte{0: {1}}, updated: time.Now()}
+	peers[2].transferMutex.Unlock()
+	peers[2].expireTransfers()
+	peers[2].transferMutex.Lock()
+	defer peers[2].transferMutex.Unlock()
+	if _, ok := peers[2].incoming["stale"]; ok {
+		t.Error("stale transfer was not dropped")
+	}
+	if _, ok := peers[2].incoming["active"]; !ok {
+		t.Error("active transfer was dropped")
+	}
+}
+
+func TestFileChunkLimits(t *testing.T) {
+	peers := startRing(t, 2, nil)
+	chunk := Message{
+		ID:         "P1-chunk",
+		Type:       MessageTypeFileChunk,
+		Sender:     "P1",
+		Recipients: []string{"P2"},
+		Content:    "c2VjcmV0",
+		MaxHops:    defaultMaxHops,
+		Ephemeral:  []byte{1},
+		Wrapped:    map[string]string{"P2": "key"},
+		File:       &FileChunk{Transfer: "P1-transfer", Name: "data.bin", Size: fileChunkSize + 1, Total: 5},
+	}
+	peers[0].signMessage(&chunk)
+	if err := peers[1].validateMessage(&chunk); err == nil {
+		t.Error("chunk count that does not match the file size passed validation")
+	}
+	encode := func(size int) string {
+		return base64.StdEncoding.EncodeToString(make([]byte, size))
+	}
+	receive := func(id string, file FileChunk, size int) bool {
+		return peers[1].receiveChunk(&Message{ID: id, Sender: "P1", File: &file}, encode(size))
+	}
+	pending := func(transfer string) bool {
+		peers[1].transferMutex.Lock()
+		defer peers[1].transferMutex.Unlock()
+		_, ok := peers[1].incoming[transfer]
+		return ok
+	}
+	if receive("oversized", FileChunk{Transfer: "oversized", Name: "a.bin", Size: 2 * fileChunkSize, Total: 2}, fileChunkSize+1) {
+		t.Error("chunk larger than the chunk size was accepted")
+	}
+	file := FileChunk{Transfer: "resized", Name: "b.bin", Size: fileChunkSize + 10, Total: 2}
+	if !receive("resized-0", file, fileChunkSize) {
+		t.Fatal("first chunk was rejected")
+	}
+	file.Seq, file.Size = 1, 2*fileChunkSize
+	if receive("resized-1", file, 10) {
+		t.Error("chunk with a different file size was accepted")
+	}
+	file = FileChunk{Transfer: "overflow", Name: "c.bin", Size: fileChunkSize + 10, Total: 2}
+	receive("overflow-0", file, 20)
+	file.Seq = 1
+	if receive("overflow-1", file, fileChunkSize) || pending("overflow") {
+		t.Error("transfer that sent more bytes than its size was kept")
+	}
+}
+
+func TestWebAPI(t *testing.T) {
+	peers := startRing(t, 3, nil)
+	token, err := peers[2].IssueToken("tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderToken, err := peers[0].IssueToken("tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(peers[2].Handler())
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	defer conn.Close()
+	waitFor(t, "websocket client to register", func() bool {
+		peers[2].clientsMutex.Lock()
+		defer peers[2].clientsMutex.Unlock()
+		return len(peers[2].clients) == 1
+	})
+	id := peers[0].Send([]string{"P3"}, "hello web")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var event Event
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		if event.Type == EventMessageReceived {
+			if event.Peer != "P3" || event.Message == nil || event.Message.ID != id || event.Message.Content != "hello web" {
+				t.Errorf("unexpected event %+v", event)
+			}
+			break
+		}
+	}
+	var page ChatPage
+	getJSON(t, server.URL+"/api/messages", token, &page)
+	if page.Total != 1 || len(page.Messages) != 1 || page.Messages[0].Direction != DirectionReceived || page.Messages[0].Message.Content != "hello web" {
+		t.Errorf("/api/messages = %+v", page)
+	}
+	waitFor(t, "delivery to P3", func() bool {
+		return deliveryStatus(peers[0], id, "P3") == DeliveryDelivered
+	})
+	sender := httptest.NewServer(peers[0].Handler())
+	defer sender.Close()
+	getJSON(t, sender.URL+"/api/messages?sender=P1", senderToken, &page)
+	if len(page.Messages) != 1 || page.Messages[0].Status["P3"] != DeliveryDelivered {
+		t.Errorf("/api/messages on the sender = %+v", page)
+	}
+	var status RingStatus
+	getJSON(t, sender.URL+"/api/peers", senderToken, &status)
+	if status.Name != "P1" || len(status.Members) != 3 || len(status.Successors) == 0 || status.Successors[0] != peers[1].Addr() {
+		t.Errorf("/api/peers = %+v", status)
+	}
+	for _, member := range status.Members {
+		if member.Self != (member.Name == "P1") || member.Name == "P2" && !member.Successor {
+			t.Errorf("member %+v", member)
+		}
+	}
+}
+
+func TestSlowWebSocketClient(t *testing.T) {
+	peers := startRing(t, 3, nil)
+	token, err := peers[1].IssueToken("tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(peers[1].Handler())
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	defer conn.Close()
+	waitFor(t, "websocket client to register", func() bool {
+		peers[1].clientsMutex.Lock()
+		defer peers[1].clientsMutex.Unlock()
+		return len(peers[1].clients) == 1
+	})
+	text := strings.Repeat("x", 64*1024)
+	start := time.Now()
+	for i := 0; i < 2*eventQueueSize; i++ {
+		peers[1].emit(Event{Type: EventMessageReceived, Text: text})
+	}
+	if elapsed := time.Since(start); elapsed >= eventWriteTimeout {
+		t.Errorf("emitting to a client that does not read took %v", elapsed)
+	}
+	peers[1].clientsMutex.Lock()
+	clients := len(peers[1].clients)
+	peers[1].clientsMutex.Unlock()
+	if clients != 0 {
+		t.Error("client that fell behind was not disconnected")
+	}
+	id := peers[0].Send([]string{"P3"}, "through P2")
+	waitFor(t, "delivery through P2", func() bool {
+		return deliveryStatus(peers[0], id, "P3") == DeliveryDelivered
+	})
+}
+
+func TestTopology(t *testing.T) {
+	peers := startRing(t, 3, nil)
+	topology := peers[0].Probe()
+	if topology.Status != TopologyComplete || len(topology.Nodes) != 3 {
+		t.Fatalf("probe of a healthy ring = %+v", topology)
+	}
+	for i, node := range topology.Nodes {
+		if node.Name != peers[i].Name() || node.Address != peers[i].Addr() || node.Successor != peers[(i+1)%3].Addr() {
+			t.Errorf("node %d = %+v", i, node)
+		}
+	}
+	peers[2].setSuccessors([]string{peers[1].Addr()})
+	topology = peers[0].Probe()
+	if topology.Status != TopologyBroken || len(topology.Nodes) != 3 || !strings.Contains(topology.Problem, "loops back to P2") {
+		t.Errorf("probe of a ring looping past the origin = %+v", topology)
+	}
+	peers[2].setSuccessors([]string{peers[0].Addr()})
+	peers[0].ringMutex.Lock()
+	peers[0].members["P9"] = "127.0.0.1:1"
+	peers[0].ringMutex.Unlock()
+	topology = peers[0].Probe()
+	if topology.Status != TopologySplit || len(topology.Missing) != 1 || topology.Missing[0] != "P9" {
+		t.Errorf("probe of a split ring = %+v", topology)
+	}
+}
+
+func TestShortestDirection(t *testing.T) {
+	peers := startRing(t, 5, nil)
+	peers[0].refreshOrder()
+	peers[0].ringMutex.Lock()
+	updated := peers[0].orderUpdated
+	peers[0].orderStale = false
+	peers[0].ringMutex.Unlock()
+	peers[0].refreshOrder()
+	peers[0].ringMutex.Lock()
+	if !peers[0].orderUpdated.Equal(updated) {
+		t.Error("ring order was probed again although nothing changed")
+	}
+	peers[0].ringMutex.Unlock()
+	if predecessor := peers[0].currentPredecessor(); predecessor != peers[4].Addr() {
+		t.Fatalf("predecessor = %q, want %q", predecessor, peers[4].Addr())
+	}
+	id := peers[0].Send([]string{"P5"}, "backwards")
+	waitFor(t, "delivery to P5", func() bool {
+		return deliveryStatus(peers[0], id, "P5") == DeliveryDelivered
+	})
+	if messages := peers[4].Received(); len(messages) != 1 || messages[0].HopCount != 0 {
+		t.Errorf("P5 received %+v, want one message after a single hop", messages)
+	}
+	id = peers[0].Send([]string{"P2", "P4"}, "both ways")
+	waitFor(t, "delivery to P2 and P4", func() bool {
+		return deliveryStatus(peers[0], id, "P2") == DeliveryDelivered && deliveryStatus(peers[0], id, "P4") == DeliveryDelivered
+	})
+	if n := received(peers[2], "both ways"); n != 0 {
+		t.Errorf("P3 is not a recipient but received %d messages", n)
+	}
+	peers[0].setPredecessor("127.0.0.1:1")
+	id = peers[0].Send([]string{"P5"}, "fallback")
+	waitFor(t, "clockwise delivery to P5", func() bool {
+		return deliveryStatus(peers[0], id, "P5") == DeliveryDelivered
+	})
+	for _, msg := range peers[4].Received() {
+		if msg.Content == "fallback" && msg.HopCount != 3 {
+			t.Errorf("fallback message reached P5 with hop count %d, want 3", msg.HopCount)
+		}
+	}
+	if predecessor := peers[0].currentPredecessor(); predecessor != "" {
+		t.Errorf("unreachable predecessor %q was kept", predecessor)
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	peers := startRing(t, 3, func(options *Options) {
+		options.MailboxTTL = time.Second
+	})
+	gone := func(peer *Peer) func() bool {
+		return func() bool {
+			peers[0].ringMutex.Lock()
+			defer peers[0].ringMutex.Unlock()
+			_, ok := peers[0].members[peer.Name()]
+			return !ok
+		}
+	}
+	options := peers[2].options
+	peers[2].Leave()
+	peers[2].Stop()
+	waitFor(t, "P3 to leave", gone(peers[2]))
+	id := peers[0].Send([]string{"P3"}, "while you were out")
+	if status := deliveryStatus(peers[0], id, "P3"); status != DeliveryQueued {
+		t.Fatalf("status = %q, want %q", status, DeliveryQueued)
+	}
+	if _, err := peers[0].sendFileData([]string{"P3"}, "notes.txt", []byte("hello")); err == nil {
+		t.Error("file transfer to an offline peer was accepted")
+	}
+	options.Address = "127.0.0.1:0"
+	options.Bootstrap = []string{peers[1].Addr()}
+	back, err := NewPeer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := back.Start(); err != nil {
+		t.Fatalf("restart P3: %v", err)
+	}
+	t.Cleanup(back.Stop)
+	waitFor(t, "held message to be delivered", func() bool {
+		return deliveryStatus(peers[0], id, "P3") == DeliveryDelivered
+	})
+	if n := received(back, "while you were out"); n != 1 {
+		t.Errorf("P3 received the held message %d times, want 1", n)
+	}
+	peers[1].Leave()
+	peers[1].Stop()
+	waitFor(t, "P2 to leave", gone(peers[1]))
+	id = peers[0].Send([]string{"P2"}, "never read")
+	waitFor(t, "held message to expire", func() bool {
+		return deliveryStatus(peers[0], id, "P2") == DeliveryExpired
+	})
+}
+
+func TestCausalOrder(t *testing.T) {
+	peers := startRing(t, 3, nil)
+	question := peers[0].Send([]string{"P2", "P3"}, "question")
+	waitFor(t, "question to reach P2 and P3", func() bool {
+		return deliveryStatus(peers[0], question, "P2") == DeliveryDelivered && deliveryStatus(peers[0], question, "P3") == DeliveryDelivered
+	})
+	answer := peers[1].Send([]string{"P3"}, "answer")
+	waitFor(t, "answer to reach P3", func() bool {
+		return deliveryStatus(peers[1], answer, "P3") == DeliveryDelivered
+	})
+	aside := peers[0].Send([]string{"P3"}, "aside")
+	waitFor(t, "aside to reach P3", func() bool {
+		return deliveryStatus(peers[0], aside, "P3") == DeliveryDelivered
+	})
+	var arrival []string
+	for _, msg := range peers[2].Received() {
+		arrival = append(arrival, msg.Content)
+	}
+	if strings.Join(arrival, ",") != "question,answer,aside" {
+		t.Fatalf("arrival order = %v", arrival)
+	}
+	page := peers[2].queryHistory(HistoryFilter{Page: 1, Size: 10})
+	var shown []string
+	var clocks []uint64
+	for _, stored := range page.Messages {
+		shown = append(shown, stored.Message.Content)
+		clocks = append(clocks, stored.Message.Clock)
+	}
+	if strings.Join(shown, ",") != "question,aside,answer" {
+		t.Errorf("history order = %v with clocks %v, want question,aside,answer", shown, clocks)
+	}
+	if clocks[2] <= clocks[0] {
+		t.Errorf("answer clock %d is not after question clock %d", clocks[2], clocks[0])
+	}
+}
+
+func TestWebAuth(t *testing.T) {
+	peers := startRing(t, 2, func(options *Options) {
+		options.Password = "secret"
+		options.AllowedOrigins = []string{"https://ring.example"}
+	})
+	server := httptest.NewServer(peers[0].Handler())
+	defer server.Close()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	post := func(path string, headers map[string]string, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	message := `{"recipient":"P2","message":"hello"}`
+	if code := post("/send", nil, message); code != http.StatusUnauthorized {
+		t.Errorf("anonymous send: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	resp, err := client.Get(server.URL + "/send?from=P1&to=P2&msg=hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /send: status %d", resp.StatusCode)
+	}
+	client.PostForm(server.URL+"/login", url.Values{"name": {"P1"}, "password": {"wrong"}})
+	if len(jar.Cookies(mustParse(t, server.URL))) != 0 {
+		t.Fatal("login with a wrong password created a session")
+	}
+	resp, err = client.PostForm(server.URL+"/login", url.Values{"name": {"P1"}, "password": {"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = client.Get(server.URL + "/api/session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info SessionInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if info.User != "P1" || info.CSRF == "" {
+		t.Fatalf("session = %+v", info)
+	}
+	if code := post("/send", nil, message); code != http.StatusForbidden {
+		t.Errorf("send without CSRF token: status %d, want %d", code, http.StatusForbidden)
+	}
+	if code := post("/send", map[string]string{csrfHeader: info.CSRF}, message); code != http.StatusOK {
+		t.Errorf("send with CSRF token: status %d, want %d", code, http.StatusOK)
+	}
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	cookie := http.Header{"Cookie": {jar.Cookies(mustParse(t, server.URL))[0].String()}}
+	for origin, allowed := range map[string]bool{"https://evil.example": false, "https://ring.example": true, server.URL: true} {
+		header := http.Header{"Origin": {origin}, "Cookie": cookie["Cookie"]}
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if allowed != (err == nil) {
+			t.Errorf("WebSocket from %s: err = %v, want allowed = %v", origin, err, allowed)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	token, err := peers[0].IssueToken("script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Jar = nil
+	if code := post("/send", map[string]string{"Authorization": "Bearer " + token}, message); code != http.StatusOK {
+		t.Errorf("send with API token: status %d, want %d", code, http.StatusOK)
+	}
+	if err := peers[0].RevokeToken("script"); err != nil {
+		t.Fatal(err)
+	}
+	if code := post("/send", map[string]string{"Authorization": "Bearer " + token}, message); code != http.StatusUnauthorized {
+		t.Errorf("send with revoked token: status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ring test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      pool,
+	}
+}
+
+func TestTransports(t *testing.T) {
+	config := testTLSConfig(t)
+	transports := map[string]string{"P1": TransportTCP, "P2": TransportTLS, "P3": TransportWS, "P4": TransportWSS}
+	peers := startRing(t, 4, func(options *Options) {
+		options.Transport = transports[options.Name]
+		options.TLSConfig = config
+	})
+	for _, peer := range peers[1:] {
+		if want := transports[peer.Name()] + "://"; !strings.HasPrefix(peer.Addr(), want) {
+			t.Errorf("%s address = %q, want prefix %q", peer.Name(), peer.Addr(), want)
+		}
+	}
+	first := peers[0].Send([]string{"P4"}, "over tcp, tls and ws")
+	second := peers[3].Send([]string{"P2"}, "back over wss")
+	waitFor(t, "delivery across transports", func() bool {
+		return deliveryStatus(peers[0], first, "P4") == DeliveryDelivered && deliveryStatus(peers[3], second, "P2") == DeliveryDelivered
+	})
+	if topology := peers[0].Probe(); topology.Status != TopologyComplete || len(topology.Nodes) != 4 {
+		t.Errorf("probe of a mixed ring = %+v", topology)
+	}
+	if _, err := NewTransport("udp", nil); err == nil {
+		t.Error("unknown transport accepted")
+	}
+	if _, err := NewTransport(TransportTLS, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (tlsTransport{}).Listen("127.0.0.1:0"); err == nil {
+		t.Error("TLS listener started without a certificate")
+	}
+}
@@ -0,0 +1,231 @@
+package ring
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(address string, timeout time.Duration) (net.Conn, error)
+}
+
+const (
+	TransportTCP = "tcp"
+	TransportTLS = "tls"
+	TransportWS  = "ws"
+	TransportWSS = "wss"
+)
+const ringPath = "/ring"
+
+func NewTransport(name string, config *tls.Config) (Transport, error) {
+	switch name {
+	case "", TransportTCP:
+		return tcpTransport{}, nil
+	case TransportTLS:
+		return tlsTransport{config: config}, nil
+	case TransportWS:
+		return wsTransport{}, nil
+	case TransportWSS:
+		return wsTransport{secure: true, config: config}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", name)
+}
+func splitAddress(addr string) (string, string, error) {
+	scheme := TransportTCP
+	if i := strings.Index(addr, "://"); i >= 0 {
+		scheme, addr = addr[:i], addr[i+3:]
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return scheme, addr, err
+}
+func joinAddress(scheme string, hostport string) string {
+	if scheme == "" || scheme == TransportTCP {
+		return hostport
+	}
+	return scheme + "://" + hostport
+}
+func serverConfig(config *tls.Config) (*tls.Config, error) {
+	if config == nil || len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return nil, errors.New("TLS transport needs a certificate")
+	}
+	return config, nil
+}
+func clientConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		return &tls.Config{}
+	}
+	return config.Clone()
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+func (tcpTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+type tlsTransport struct {
+	config *tls.Config
+}
+
+func (t tlsTransport) Listen(address string) (net.Listener, error) {
+	config, err := serverConfig(t.config)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", address, config)
+}
+func (t tlsTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, clientConfig(t.config))
+}
+
+type wsTransport struct {
+	secure bool
+	config *tls.Config
+}
+
+func (t wsTransport) Listen(address string) (net.Listener, error) {
+	var config *tls.Config
+	if t.secure {
+		var err error
+		config, err = serverConfig(t.config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	ws := &wsListener{
+		Listener: listener,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return r.Header.Get("Origin") == "" },
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(ringPath, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		select {
+		case ws.conns <- &wsConn{Conn: conn}:
+		case <-ws.done:
+			conn.Close()
+		}
+	})
+	ws.server = &http.Server{Handler: mux}
+	go ws.server.Serve(listener)
+	return ws, nil
+}
+func (t wsTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	scheme := TransportWS
+	if t.secure {
+		scheme = TransportWSS
+	}
+	dialer := websocket.Dialer{
+		NetDial:          (&net.Dialer{Timeout: timeout}).Dial,
+		HandshakeTimeout: timeout,
+		TLSClientConfig:  clientConfig(t.config),
+	}
+	conn, _, err := dialer.Dial(scheme+"://"+address+ringPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{Conn: conn}, nil
+}
+
+type wsListener struct {
+	net.Listener
+	server *http.Server
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+func (l *wsListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.server.Close()
+	})
+	return err
+}
+
+type wsConn struct {
+	*websocket.Conn
+	reader     io.Reader
+	writeMutex sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, reader, err := c.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	err := c.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+func (c *wsConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+func (c *wsConn) Close() error {
+	c.writeMutex.Lock()
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.writeMutex.Unlock()
+	return c.Conn.Close()
+}